@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"github.com/golang/glog"
+	goredisv9 "github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+)
+
+// autoChunkMarker starts the value we store at the key of auto-chunked SETs,
+// followed by the value's manifest (JSON).
+const autoChunkMarker = "\x00JPD"
+
+var (
+	autoChunkSets    = metrics.Counter("autochunk_sets")
+	autoChunkGets    = metrics.Counter("autochunk_gets")
+	autoChunkCleaned = metrics.Counter("autochunk_cleaned")
+	autoChunkExpired = metrics.Counter("autochunk_expired")
+
+	// autoChunkCmds are the commands that can remove, replace or expire
+	// markers; see autoChunkExec.
+	autoChunkCmds = map[string]bool{
+		"del": true, "unlink": true, "getdel": true, "set": true, "setnx": true,
+		"setex": true, "psetex": true, "getset": true, "mset": true, "msetnx": true,
+		"expire": true, "pexpire": true, "expireat": true, "pexpireat": true,
+		"persist": true, "getex": true,
+	}
+
+	// autoChunkTTLCmds are the autoChunkCmds that only change the TTL of
+	// their (single) key.
+	autoChunkTTLCmds = map[string]bool{
+		"expire": true, "pexpire": true, "expireat": true, "pexpireat": true,
+		"persist": true, "getex": true,
+	}
+
+	// ARGV: the marker, then the command. Returns the command's reply, then
+	// each key in KEYS whose marker it removed or replaced, and that marker.
+	// Errors are returned as is, as nothing was changed. Other types fail
+	// GETRANGE, which is all we need to know about them.
+	autoChunkScript = `local old = {}
+for i, k in ipairs(KEYS) do
+  if redis.pcall('GETRANGE', k, 0, #ARGV[1] - 1) == ARGV[1] then
+    old[i] = redis.call('GET', k)
+  end
+end
+local r = redis.pcall(unpack(ARGV, 2))
+if type(r) == 'table' and r.err then return r end
+local out = {r}
+for i, k in ipairs(KEYS) do
+  if old[i] and redis.call('GET', k) ~= old[i] then
+    out[#out + 1] = k
+    out[#out + 1] = old[i]
+  end
+end
+return out`
+
+	// Same as autoChunkScript, for autoChunkTTLCmds. Returns the command's
+	// reply, then, if KEYS[1] holds a marker, that marker, and its PTTL after
+	// the command (-2 if it's gone, i.e. EXPIRE with a negative TTL).
+	autoChunkTTLScript = `local m = false
+if redis.pcall('GETRANGE', KEYS[1], 0, #ARGV[1] - 1) == ARGV[1] then m = redis.call('GET', KEYS[1]) end
+local r = redis.pcall(unpack(ARGV, 2))
+if type(r) == 'table' and r.err then return r end
+if not m then return {r} end
+return {r, m, redis.call('PTTL', KEYS[1])}`
+)
+
+// autoChunkGone is an auto-chunked value whose marker was removed or replaced.
+type autoChunkGone struct {
+	key string
+	m   *distManifest
+}
+
+// autoChunkSet stores SET (or SETEX/PSETEX) values above -autochunk bytes as
+// DISTSET values, then a marker at the key itself, that GET follows. Returns
+// false if cmd is not one of those (i.e. small values, or options other than
+// EX/PX), for the caller to proxy as usual.
+func autoChunkSet(conn redcon.Conn, cmd redcon.Command, meta metaT) bool {
+	if *flags.AutoChunk <= 0 || meta.member != "" || meta.fanout {
+		return false // directed commands are left alone
+	}
+
+	var key, value []byte
+	var ttl time.Duration
+	args := cmd.Args
+	switch strings.ToLower(string(args[0])) {
+	case "set":
+		if len(args) != 3 && len(args) != 5 {
+			return false
+		}
+
+		key, value = args[1], args[2]
+		if len(args) == 5 {
+			n, err := strconv.ParseInt(string(args[4]), 10, 64)
+			if err != nil || n <= 0 {
+				return false // let Redis complain
+			}
+
+			switch strings.ToLower(string(args[3])) {
+			case "ex":
+				ttl = time.Duration(n) * time.Second
+			case "px":
+				ttl = time.Duration(n) * time.Millisecond
+			default:
+				return false
+			}
+		}
+	case "setex", "psetex":
+		if len(args) != 4 {
+			return false
+		}
+
+		n, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || n <= 0 {
+			return false
+		}
+
+		key, value = args[1], args[3]
+		ttl = time.Duration(n) * time.Second
+		if strings.EqualFold(string(args[0]), "psetex") {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+	default:
+		return false
+	}
+
+	if !autoChunked(len(value)) {
+		return false
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	hash := meta.key
+	if hash == "" {
+		hash = string(key)
+	}
+
+	if err := meta.this.autoChunkPut(ctx, string(key), hash, value, ttl, meta.layout); err != nil {
+		conn.WriteError(err.Error())
+		return true
+	}
+
+	conn.WriteString("OK")
+	return true
+}
+
+// autoChunkPut stores value as a DISTSET value, then its marker at nkey, in
+// the owner of hash. The marker goes last, so GET never sees partial values.
+func (p *proxy) autoChunkPut(ctx context.Context, nkey, hash string, value []byte, ttl time.Duration, layout string) error {
+	begin := time.Now()
+	if layout == "" {
+		layout = *flags.ChunkLayout
+	}
+
+	m, err := p.distSet(ctx, nkey, value, ttl, *flags.ChunkSize, layout)
+	if err != nil {
+		return err
+	}
+
+	b, _ := json.Marshal(m)
+	set := [][]byte{[]byte("SET"), []byte(nkey), append([]byte(autoChunkMarker), b...)}
+	if ttl > 0 {
+		set = append(set, []byte("PX"), []byte(fmt.Sprint(ttl.Milliseconds())))
+	}
+
+	_, gone, err := p.autoChunkExec(ctx, hash, set)
+	if err != nil {
+		return fmt.Errorf("ERR write %v failed: %w", nkey, err)
+	}
+
+	p.autoChunkClean(ctx, gone, m)
+	autoChunkSets.Add(1)
+	glog.Infof("[autoChunkPut] key=%v, chunks=%v, len=%v, took %v", nkey, m.Chunks, len(value), time.Since(begin))
+	return nil
+}
+
+// autoChunkExec sends args to the owner of hash, and returns its reply, and
+// the auto-chunked values it removed or replaced, if it's one of
+// autoChunkCmds (and -autochunk is on), for autoChunkClean. The check and the
+// command are one script, so the markers we return are exactly those gone.
+// For autoChunkTTLCmds, the chunks get the marker's new TTL before we return.
+func (p *proxy) autoChunkExec(ctx context.Context, hash string, args [][]byte) (interface{}, []autoChunkGone, error) {
+	name := strings.ToLower(string(args[0]))
+	ci, ok := commandTable[name]
+	if *flags.AutoChunk <= 0 || !autoChunkCmds[name] || !ok {
+		v, err := p.cluster.Do(ctx, hash, args)
+		return v, nil, err
+	}
+
+	script := autoChunkScript
+	if autoChunkTTLCmds[name] {
+		script = autoChunkTTLScript
+	}
+
+	keys := ci.keys(args)
+	eval := [][]byte{[]byte("EVALSHA"), []byte(cluster.ScriptSha1(script)), []byte(fmt.Sprint(len(keys)))}
+	for _, k := range keys {
+		eval = append(eval, []byte(k))
+	}
+
+	eval = append(eval, []byte(autoChunkMarker))
+	eval = append(eval, args...)
+	v, err := p.cluster.Do(ctx, hash, eval)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		eval[0], eval[1] = []byte("EVAL"), []byte(script)
+		v, err = p.cluster.Do(ctx, hash, eval)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l, ok := v.([]interface{})
+	if !ok || len(l) == 0 {
+		return nil, nil, fmt.Errorf("ERR unexpected reply for %v: %T", name, v)
+	}
+
+	var gone []autoChunkGone
+	switch {
+	case autoChunkTTLCmds[name]:
+		if len(l) < 3 {
+			break
+		}
+
+		m, ok := autoChunkManifest(l[1])
+		ttl, _ := l[2].(int64)
+		switch {
+		case !ok:
+		case ttl == -2:
+			gone = append(gone, autoChunkGone{key: keys[0], m: m})
+		default:
+			p.autoChunkExpire(ctx, keys[0], m, ttl)
+		}
+	default:
+		for i := 1; i+1 < len(l); i += 2 {
+			k, _ := l[i].(string)
+			if m, ok := autoChunkManifest(l[i+1]); ok {
+				gone = append(gone, autoChunkGone{key: k, m: m})
+			}
+		}
+	}
+
+	if l[0] == nil {
+		return nil, gone, goredisv9.Nil // as if sent as is
+	}
+
+	return l[0], gone, nil
+}
+
+// autoChunkClean removes the chunks (and 'key/len') of gone values, except
+// those that were just overwritten by keep (the new value at the same key),
+// if not nil.
+func (p *proxy) autoChunkClean(ctx context.Context, gone []autoChunkGone, keep *distManifest) {
+	if len(gone) == 0 {
+		return
+	}
+
+	// The command is done, even if its caller is gone; this is on us.
+	ctx, cancel := cluster.WithTimeout(context.WithoutCancel(ctx), 0)
+	defer cancel()
+	for _, g := range gone {
+		owners := make(map[string][]string)
+		if keep == nil {
+			keyLen := fmt.Sprintf("%v/len", g.key)
+			host := p.cluster.Locate(keyLen)
+			owners[host] = append(owners[host], keyLen)
+		}
+
+		for i := 0; i < g.m.Chunks; i++ {
+			host := p.cluster.ChunkOwner(g.key, i, g.m.Layout)
+			if keep != nil && i < keep.Chunks && host == p.cluster.ChunkOwner(g.key, i, keep.Layout) {
+				continue // same key, same member: overwritten
+			}
+
+			owners[host] = append(owners[host], cluster.ChunkKey(g.key, i))
+		}
+
+		err := p.distEach(ctx, owners, func(host string, keys []string) error {
+			args := [][]byte{[]byte("DEL")}
+			for _, k := range keys {
+				args = append(args, []byte(k))
+			}
+
+			_, err := p.cluster.DoMember(ctx, host, args)
+			return err
+		})
+
+		if err != nil {
+			glog.Errorf("[autoChunkClean] %v: %v", g.key, err)
+			continue
+		}
+
+		autoChunkCleaned.Add(1)
+	}
+}
+
+// autoChunkExpire sets the TTL of the chunks (and 'key/len') of the
+// auto-chunked value at nkey, described by m, to ttl (ms; -1 for none), the
+// new TTL of its marker. Set after the marker's, so chunks never expire first.
+func (p *proxy) autoChunkExpire(ctx context.Context, nkey string, m *distManifest, ttl int64) {
+	// Same as autoChunkClean; the command is done.
+	ctx, cancel := cluster.WithTimeout(context.WithoutCancel(ctx), 0)
+	defer cancel()
+	err := p.distEach(ctx, p.distOwners(nkey, m.Chunks, m.Layout, true),
+		func(host string, keys []string) error {
+			_, err := p.distEval(ctx, host, distExpireScript, keys, fmt.Sprint(ttl))
+			return err
+		},
+	)
+
+	if err != nil {
+		glog.Errorf("[autoChunkExpire] %v: %v", nkey, err)
+		return
+	}
+
+	autoChunkExpired.Add(1)
+}
+
+// autoChunkDo is autoChunkExec, then autoChunkClean; for our front-ends that
+// don't need the markers themselves.
+func (p *proxy) autoChunkDo(ctx context.Context, hash string, args [][]byte) (interface{}, error) {
+	v, gone, err := p.autoChunkExec(ctx, hash, args)
+	p.autoChunkClean(ctx, gone, nil)
+	return v, err
+}
+
+// autoChunked returns true if SET values of n bytes are auto-chunked.
+func autoChunked(n int) bool { return *flags.AutoChunk > 0 && n > *flags.AutoChunk }
+
+// autoChunkManifest returns the manifest in v, if it's an auto-chunk marker.
+func autoChunkManifest(v interface{}) (*distManifest, bool) {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, autoChunkMarker) {
+		return nil, false
+	}
+
+	m := distManifest{Layout: cluster.LayoutHashed}
+	if err := json.Unmarshal([]byte(s[len(autoChunkMarker):]), &m); err != nil || !m.valid() {
+		return nil, false // not ours after all
+	}
+
+	return &m, true
+}
+
+// autoChunkGet writes the value of nkey, described by m, to w, the same way
+// as DISTGET. If the chunks don't match m (i.e. nkey was written again with
+// DISTSET), 'nkey/len' is used instead.
+func (p *proxy) autoChunkGet(ctx context.Context, nkey string, m *distManifest, w distSink) error {
+	autoChunkGets.Add(1)
+	begun, err := p.distRead(ctx, nkey, m, 0, m.Chunks-1, w)
+	if errors.Is(err, errChecksum) && !begun {
+		_, err = p.distGet(ctx, nkey, 0, "", w)
+	}
+
+	return err
+}
+
+// autoChunkValue returns v, or the whole value, read into memory, if it's an
+// auto-chunk marker; for our front-ends that can't stream replies.
+func (p *proxy) autoChunkValue(ctx context.Context, nkey string, v interface{}) (interface{}, error) {
+	m, ok := autoChunkManifest(v)
+	if !ok {
+		return v, nil
+	}
+
+	var b bufferSink
+	if err := p.autoChunkGet(ctx, nkey, m, &b); err != nil {
+		return nil, err
+	}
+
+	return b.String(), nil
+}
+
+// bufferSink is a distSink in memory.
+type bufferSink struct{ bytes.Buffer }
+
+func (b *bufferSink) Begin(size int64) error {
+	b.Grow(int(size))
+	return nil
+}
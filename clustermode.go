@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/tidwall/redcon"
+)
+
+const clusterSlots = 16384
+
+// clusterNode is one proxy in the fleet, as presented to Redis Cluster
+// clients. Each proxy "owns" a contiguous range of slots, but since any proxy
+// can route any key, clients never get redirected.
+type clusterNode struct {
+	id    string // 40 hex chars, like Redis
+	ip    string
+	port  int
+	start int
+	end   int
+	self  bool
+}
+
+// clusterNodes splits all slots evenly across the proxy fleet. All proxies
+// compute the same layout since members are sorted first.
+func (p *proxy) clusterNodes() []clusterNode {
+	port := 6379
+	if _, ps, err := net.SplitHostPort(*flags.RedisAddr); err == nil {
+		port, _ = strconv.Atoi(ps)
+	}
+
+	self := p.app.FleetOp.Name()
+	members := p.app.FleetOp.Members()
+	if len(members) == 0 {
+		members = []string{self}
+	}
+
+	sort.Strings(members)
+	nodes := []clusterNode{}
+	n := len(members)
+	for i, m := range members {
+		host, _, _ := net.SplitHostPort(m) // hedge's host:port
+		h := sha1.Sum([]byte(m))
+		nodes = append(nodes, clusterNode{
+			id:    hex.EncodeToString(h[:]),
+			ip:    host,
+			port:  port,
+			start: i * clusterSlots / n,
+			end:   (i+1)*clusterSlots/n - 1,
+			self:  m == self,
+		})
+	}
+
+	return nodes
+}
+
+// clusterCmd answers CLUSTER subcommands as if the proxy fleet is a Redis
+// Cluster where each proxy is a master with no replicas.
+func clusterCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'cluster' command")
+		return
+	}
+
+	nodes := meta.this.clusterNodes()
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "info":
+		var b strings.Builder
+		fmt.Fprintf(&b, "cluster_state:ok\r\n")
+		fmt.Fprintf(&b, "cluster_slots_assigned:%v\r\n", clusterSlots)
+		fmt.Fprintf(&b, "cluster_slots_ok:%v\r\n", clusterSlots)
+		fmt.Fprintf(&b, "cluster_slots_pfail:0\r\n")
+		fmt.Fprintf(&b, "cluster_slots_fail:0\r\n")
+		fmt.Fprintf(&b, "cluster_known_nodes:%v\r\n", len(nodes))
+		fmt.Fprintf(&b, "cluster_size:%v\r\n", len(nodes))
+		fmt.Fprintf(&b, "cluster_current_epoch:1\r\n")
+		fmt.Fprintf(&b, "cluster_my_epoch:1\r\n")
+		conn.WriteBulkString(b.String())
+	case "myid":
+		for _, n := range nodes {
+			if n.self {
+				conn.WriteBulkString(n.id)
+				return
+			}
+		}
+
+		conn.WriteBulkString(nodes[0].id)
+	case "slots":
+		conn.WriteArray(len(nodes))
+		for _, n := range nodes {
+			conn.WriteArray(3)
+			conn.WriteInt(n.start)
+			conn.WriteInt(n.end)
+			conn.WriteArray(3)
+			conn.WriteBulkString(n.ip)
+			conn.WriteInt(n.port)
+			conn.WriteBulkString(n.id)
+		}
+	case "shards":
+		conn.WriteArray(len(nodes))
+		for _, n := range nodes {
+			conn.WriteArray(4)
+			conn.WriteBulkString("slots")
+			conn.WriteArray(2)
+			conn.WriteInt(n.start)
+			conn.WriteInt(n.end)
+			conn.WriteBulkString("nodes")
+			conn.WriteArray(1)
+			conn.WriteArray(14)
+			conn.WriteBulkString("id")
+			conn.WriteBulkString(n.id)
+			conn.WriteBulkString("port")
+			conn.WriteInt(n.port)
+			conn.WriteBulkString("ip")
+			conn.WriteBulkString(n.ip)
+			conn.WriteBulkString("endpoint")
+			conn.WriteBulkString(n.ip)
+			conn.WriteBulkString("role")
+			conn.WriteBulkString("master")
+			conn.WriteBulkString("replication-offset")
+			conn.WriteInt(0)
+			conn.WriteBulkString("health")
+			conn.WriteBulkString("online")
+		}
+	case "nodes":
+		var b strings.Builder
+		for _, n := range nodes {
+			fl := "master"
+			if n.self {
+				fl = "myself,master"
+			}
+
+			fmt.Fprintf(&b, "%v %v:%v@%v %v - 0 0 1 connected %v-%v\n",
+				n.id, n.ip, n.port, n.port+10000, fl, n.start, n.end)
+		}
+
+		conn.WriteBulkString(b.String())
+	case "keyslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster|keyslot' command")
+			return
+		}
+
+		conn.WriteInt(keySlot(cmd.Args[2]))
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", cmd.Args[1]))
+	}
+}
+
+// okCmd is for commands that cluster clients send, but are meaningless to us,
+// i.e. READONLY, READWRITE and ASKING.
+func okCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) { conn.WriteString("OK") }
+
+// keySlot returns the Redis Cluster hash slot for key, honoring {hashtags}.
+func keySlot(key []byte) int {
+	if s := strings.IndexByte(string(key), '{'); s >= 0 {
+		if e := strings.IndexByte(string(key[s+1:]), '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) variant used by Redis Cluster.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint16
+	}{
+		{"", 0},
+		{"123456789", 0x31c3}, // the check value of CRC16-CCITT (XMODEM)
+	} {
+		if got := crc16([]byte(tc.in)); got != tc.want {
+			t.Errorf("crc16(%q) = %#x, want %#x", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		want int
+		same string // if set, key hashes as this one instead
+	}{
+		// Same as CLUSTER KEYSLOT.
+		{key: "foo", want: 12182},
+		{key: "bar", want: 5061},
+		{key: "hello", want: 866},
+		{key: "somekey", want: 11058},
+		{key: "", want: 0},
+
+		// Hashtags, as in the Redis Cluster spec.
+		{key: "{user1000}.following", same: "user1000"},
+		{key: "{user1000}.followers", same: "user1000"},
+		{key: "foo{bar}", same: "bar"},
+		{key: "foo{bar}{zap}", same: "bar"},     // first one only
+		{key: "foo{{bar}}zap", same: "{bar"},    // up to the first '}'
+		{key: "foo{}{bar}", same: "foo{}{bar}"}, // empty; the whole key
+		{key: "foo{bar", same: "foo{bar"},       // not closed
+		{key: "foo}bar{", same: "foo}bar{"},
+		{key: "{}", same: "{}"},
+	} {
+		want := tc.want
+		if tc.same != "" {
+			want = int(crc16([]byte(tc.same))) % clusterSlots
+		}
+
+		if got := keySlot([]byte(tc.key)); got != want {
+			t.Errorf("keySlot(%q) = %v, want %v", tc.key, got, want)
+		}
+	}
+}
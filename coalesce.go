@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+)
+
+// setCoalesce parses -coalesce, a comma-separated list of read-only commands.
+func setCoalesce(s string) error {
+	cmds := []string{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+
+		ci, ok := commandTable[c]
+		if !ok || ci.support != cmdProxied || !ci.hasFlag("readonly") {
+			return fmt.Errorf("invalid -coalesce entry '%v': not a proxied, read-only command", c)
+		}
+
+		cmds = append(cmds, c)
+	}
+
+	return cluster.SetCoalesce(cmds)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+const (
+	cmdProxied     = iota // sent as is to the member that owns the key
+	cmdJupiter            // our own extension, handled by the proxy
+	cmdUnsupported        // sent to a member, but won't work as expected
+)
+
+// cmdInfo describes a command for COMMAND/COMMAND INFO/COMMAND DOCS. Arity and
+// key positions follow Redis' conventions (negative arity means at least
+// -arity args, lastKey -1 means the last arg).
+type cmdInfo struct {
+	name     string
+	arity    int
+	flags    string // space-separated
+	firstKey int
+	lastKey  int
+	step     int
+	group    string
+	support  int
+	summary  string
+}
+
+func (ci *cmdInfo) hasFlag(f string) bool {
+	for _, v := range strings.Fields(ci.flags) {
+		if v == f {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keys returns the keys in args, per ci's key positions. None for commands
+// with movable keys.
+func (ci *cmdInfo) keys(args [][]byte) []string {
+	if ci.firstKey <= 0 || ci.step <= 0 {
+		return nil
+	}
+
+	last := ci.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+
+	keys := []string{}
+	for i := ci.firstKey; i <= last && i < len(args); i += ci.step {
+		keys = append(keys, string(args[i]))
+	}
+
+	return keys
+}
+
+// aclCategories derives the ACL categories from the group and flags.
+func (ci *cmdInfo) aclCategories() []string {
+	cats := []string{"@" + ci.group}
+	switch {
+	case ci.hasFlag("readonly"):
+		cats = append(cats, "@read")
+	case ci.hasFlag("write"):
+		cats = append(cats, "@write")
+	}
+
+	switch {
+	case ci.hasFlag("fast"):
+		cats = append(cats, "@fast")
+	default:
+		cats = append(cats, "@slow")
+	}
+
+	return cats
+}
+
+var (
+	commandList = []*cmdInfo{
+		// Strings.
+		{"get", 2, "readonly fast", 1, 1, 1, "string", cmdProxied, "Returns the string value of a key."},
+		{"set", -3, "write denyoom", 1, 1, 1, "string", cmdProxied, "Sets the string value of a key, ignoring its type."},
+		{"setex", 4, "write denyoom", 1, 1, 1, "string", cmdProxied, "Sets the string value and expiration time of a key."},
+		{"psetex", 4, "write denyoom", 1, 1, 1, "string", cmdProxied, "Sets both string value and expiration time in milliseconds of a key."},
+		{"setnx", 3, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Set the string value of a key only when the key doesn't exist."},
+		{"getset", 3, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Returns the previous string value of a key after setting it to a new value."},
+		{"getdel", 2, "write fast", 1, 1, 1, "string", cmdProxied, "Returns the string value of a key after deleting the key."},
+		{"getex", -2, "write fast", 1, 1, 1, "string", cmdProxied, "Returns the string value of a key after setting its expiration time."},
+		{"mget", -2, "readonly fast", 1, -1, 1, "string", cmdProxied, "Atomically returns the string values of one or more keys. All keys must be on the same member."},
+		{"mset", -3, "write denyoom", 1, -1, 2, "string", cmdProxied, "Atomically creates or modifies the string values of one or more keys. All keys must be on the same member."},
+		{"msetnx", -3, "write denyoom", 1, -1, 2, "string", cmdProxied, "Atomically modifies the string values of one or more keys only when all keys don't exist."},
+		{"incr", 2, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Increments the integer value of a key by one."},
+		{"incrby", 3, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Increments the integer value of a key by a number."},
+		{"incrbyfloat", 3, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Increment the floating point value of a key by a number."},
+		{"decr", 2, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Decrements the integer value of a key by one."},
+		{"decrby", 3, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Decrements a number from the integer value of a key."},
+		{"append", 3, "write denyoom fast", 1, 1, 1, "string", cmdProxied, "Appends a string to the value of a key."},
+		{"strlen", 2, "readonly fast", 1, 1, 1, "string", cmdProxied, "Returns the length of a string value."},
+		{"getrange", 4, "readonly", 1, 1, 1, "string", cmdProxied, "Returns a substring of the string stored at a key."},
+		{"setrange", 4, "write denyoom", 1, 1, 1, "string", cmdProxied, "Overwrites a part of a string value with another by an offset."},
+
+		// Generic.
+		{"del", -2, "write", 1, -1, 1, "generic", cmdProxied, "Deletes one or more keys. All keys must be on the same member."},
+		{"unlink", -2, "write fast", 1, -1, 1, "generic", cmdProxied, "Asynchronously deletes one or more keys. All keys must be on the same member."},
+		{"exists", -2, "readonly fast", 1, -1, 1, "generic", cmdProxied, "Determines whether one or more keys exist."},
+		{"expire", -3, "write fast", 1, 1, 1, "generic", cmdProxied, "Sets the expiration time of a key in seconds."},
+		{"pexpire", -3, "write fast", 1, 1, 1, "generic", cmdProxied, "Sets the expiration time of a key in milliseconds."},
+		{"expireat", -3, "write fast", 1, 1, 1, "generic", cmdProxied, "Sets the expiration time of a key to a Unix timestamp."},
+		{"pexpireat", -3, "write fast", 1, 1, 1, "generic", cmdProxied, "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+		{"ttl", 2, "readonly fast", 1, 1, 1, "generic", cmdProxied, "Returns the expiration time in seconds of a key."},
+		{"pttl", 2, "readonly fast", 1, 1, 1, "generic", cmdProxied, "Returns the expiration time in milliseconds of a key."},
+		{"persist", 2, "write fast", 1, 1, 1, "generic", cmdProxied, "Removes the expiration time of a key."},
+		{"type", 2, "readonly fast", 1, 1, 1, "generic", cmdProxied, "Determines the type of value stored at a key."},
+		{"touch", -2, "readonly fast", 1, -1, 1, "generic", cmdProxied, "Returns the number of existing keys out of those specified after updating the time they were last accessed."},
+		{"rename", 3, "write", 1, 2, 1, "generic", cmdProxied, "Renames a key and overwrites the destination. Both keys must be on the same member."},
+		{"dump", 2, "readonly", 1, 1, 1, "generic", cmdProxied, "Returns a serialized representation of the value stored at a key."},
+		{"restore", -4, "write denyoom", 1, 1, 1, "generic", cmdProxied, "Creates a key from the serialized representation of a value."},
+		{"scan", -2, "readonly", 0, 0, 0, "generic", cmdProxied, "Iterates over the key names in a member. Use a hash key to select the member."},
+		{"keys", 2, "readonly", 0, 0, 0, "generic", cmdProxied, "Returns all key names that match a pattern in a member. Use a hash key to select the member."},
+		{"randomkey", 1, "readonly", 0, 0, 0, "generic", cmdProxied, "Returns a random key name from a random member."},
+
+		// Hashes.
+		{"hset", -4, "write denyoom fast", 1, 1, 1, "hash", cmdProxied, "Creates or modifies the value of a field in a hash."},
+		{"hsetnx", 4, "write denyoom fast", 1, 1, 1, "hash", cmdProxied, "Sets the value of a field in a hash only when the field doesn't exist."},
+		{"hmset", -4, "write denyoom fast", 1, 1, 1, "hash", cmdProxied, "Sets the values of multiple fields."},
+		{"hget", 3, "readonly fast", 1, 1, 1, "hash", cmdProxied, "Returns the value of a field in a hash."},
+		{"hmget", -3, "readonly fast", 1, 1, 1, "hash", cmdProxied, "Returns the values of multiple fields in a hash."},
+		{"hdel", -3, "write fast", 1, 1, 1, "hash", cmdProxied, "Deletes one or more fields and their values from a hash."},
+		{"hexists", 3, "readonly fast", 1, 1, 1, "hash", cmdProxied, "Determines whether a field exists in a hash."},
+		{"hgetall", 2, "readonly", 1, 1, 1, "hash", cmdProxied, "Returns all fields and values in a hash."},
+		{"hkeys", 2, "readonly", 1, 1, 1, "hash", cmdProxied, "Returns all fields in a hash."},
+		{"hvals", 2, "readonly", 1, 1, 1, "hash", cmdProxied, "Returns all values in a hash."},
+		{"hlen", 2, "readonly fast", 1, 1, 1, "hash", cmdProxied, "Returns the number of fields in a hash."},
+		{"hstrlen", 3, "readonly fast", 1, 1, 1, "hash", cmdProxied, "Returns the length of the value of a field."},
+		{"hincrby", 4, "write denyoom fast", 1, 1, 1, "hash", cmdProxied, "Increments the integer value of a field in a hash by a number."},
+		{"hincrbyfloat", 4, "write denyoom fast", 1, 1, 1, "hash", cmdProxied, "Increments the floating point value of a field by a number."},
+		{"hscan", -3, "readonly", 1, 1, 1, "hash", cmdProxied, "Iterates over fields and values of a hash."},
+
+		// Lists.
+		{"lpush", -3, "write denyoom fast", 1, 1, 1, "list", cmdProxied, "Prepends one or more elements to a list."},
+		{"rpush", -3, "write denyoom fast", 1, 1, 1, "list", cmdProxied, "Appends one or more elements to a list."},
+		{"lpop", -2, "write fast", 1, 1, 1, "list", cmdProxied, "Returns the first elements in a list after removing it."},
+		{"rpop", -2, "write fast", 1, 1, 1, "list", cmdProxied, "Returns and removes the last elements of a list."},
+		{"llen", 2, "readonly fast", 1, 1, 1, "list", cmdProxied, "Returns the length of a list."},
+		{"lrange", 4, "readonly", 1, 1, 1, "list", cmdProxied, "Returns a range of elements from a list."},
+		{"lindex", 3, "readonly", 1, 1, 1, "list", cmdProxied, "Returns an element from a list by its index."},
+		{"lset", 4, "write denyoom", 1, 1, 1, "list", cmdProxied, "Sets the value of an element in a list by its index."},
+		{"lrem", 4, "write", 1, 1, 1, "list", cmdProxied, "Removes elements from a list."},
+		{"ltrim", 4, "write", 1, 1, 1, "list", cmdProxied, "Removes elements from both ends a list."},
+		{"linsert", 5, "write denyoom", 1, 1, 1, "list", cmdProxied, "Inserts an element before or after another element in a list."},
+		{"lpos", -3, "readonly", 1, 1, 1, "list", cmdProxied, "Returns the index of matching elements in a list."},
+
+		// Sets.
+		{"sadd", -3, "write denyoom fast", 1, 1, 1, "set", cmdProxied, "Adds one or more members to a set."},
+		{"srem", -3, "write fast", 1, 1, 1, "set", cmdProxied, "Removes one or more members from a set."},
+		{"smembers", 2, "readonly", 1, 1, 1, "set", cmdProxied, "Returns all members of a set."},
+		{"sismember", 3, "readonly fast", 1, 1, 1, "set", cmdProxied, "Determines whether a member belongs to a set."},
+		{"smismember", -3, "readonly fast", 1, 1, 1, "set", cmdProxied, "Determines whether multiple members belong to a set."},
+		{"scard", 2, "readonly fast", 1, 1, 1, "set", cmdProxied, "Returns the number of members in a set."},
+		{"spop", -2, "write fast", 1, 1, 1, "set", cmdProxied, "Returns one or more random members from a set after removing them."},
+		{"srandmember", -2, "readonly", 1, 1, 1, "set", cmdProxied, "Get one or multiple random members from a set."},
+		{"sscan", -3, "readonly", 1, 1, 1, "set", cmdProxied, "Iterates over members of a set."},
+
+		// Sorted sets.
+		{"zadd", -4, "write denyoom fast", 1, 1, 1, "sorted-set", cmdProxied, "Adds one or more members to a sorted set, or updates their scores."},
+		{"zrem", -3, "write fast", 1, 1, 1, "sorted-set", cmdProxied, "Removes one or more members from a sorted set."},
+		{"zscore", 3, "readonly fast", 1, 1, 1, "sorted-set", cmdProxied, "Returns the score of a member in a sorted set."},
+		{"zmscore", -3, "readonly fast", 1, 1, 1, "sorted-set", cmdProxied, "Returns the score of one or more members in a sorted set."},
+		{"zincrby", 4, "write denyoom fast", 1, 1, 1, "sorted-set", cmdProxied, "Increments the score of a member in a sorted set."},
+		{"zcard", 2, "readonly fast", 1, 1, 1, "sorted-set", cmdProxied, "Returns the number of members in a sorted set."},
+		{"zcount", 4, "readonly fast", 1, 1, 1, "sorted-set", cmdProxied, "Returns the count of members in a sorted set that have scores within a range."},
+		{"zrange", -4, "readonly", 1, 1, 1, "sorted-set", cmdProxied, "Returns members in a sorted set within a range of indexes."},
+		{"zrangebyscore", -4, "readonly", 1, 1, 1, "sorted-set", cmdProxied, "Returns members in a sorted set within a range of scores."},
+		{"zrevrange", -4, "readonly", 1, 1, 1, "sorted-set", cmdProxied, "Returns members in a sorted set within a range of indexes in reverse order."},
+		{"zrevrangebyscore", -4, "readonly", 1, 1, 1, "sorted-set", cmdProxied, "Returns members in a sorted set within a range of scores in reverse order."},
+		{"zrank", -3, "readonly fast", 1, 1, 1, "sorted-set", cmdProxied, "Returns the index of a member in a sorted set ordered by ascending scores."},
+		{"zrevrank", -3, "readonly fast", 1, 1, 1, "sorted-set", cmdProxied, "Returns the index of a member in a sorted set ordered by descending scores."},
+		{"zremrangebyrank", 4, "write", 1, 1, 1, "sorted-set", cmdProxied, "Removes members in a sorted set within a range of indexes."},
+		{"zremrangebyscore", 4, "write", 1, 1, 1, "sorted-set", cmdProxied, "Removes members in a sorted set within a range of scores."},
+		{"zscan", -3, "readonly", 1, 1, 1, "sorted-set", cmdProxied, "Iterates over members and scores of a sorted set."},
+
+		// Server and connection.
+		{"ping", -1, "fast", 0, 0, 0, "connection", cmdJupiter, "Returns PONG from the proxy, or from the member that owns the hash key if provided."},
+		{"echo", 2, "fast", 0, 0, 0, "connection", cmdProxied, "Returns the given string."},
+		{"quit", -1, "fast", 0, 0, 0, "connection", cmdJupiter, "Closes the connection."},
+		{"time", 1, "fast", 0, 0, 0, "server", cmdProxied, "Returns the server time of a random member."},
+		{"dbsize", 1, "readonly fast", 0, 0, 0, "server", cmdProxied, "Returns the number of keys in a member. Use a hash key to select the member."},
+		{"flushdb", -1, "write", 0, 0, 0, "server", cmdProxied, "Removes all keys from a member. Use a hash key to select the member."},
+		{"flushall", -1, "write", 0, 0, 0, "server", cmdProxied, "Removes all keys from a member. Use a hash key to select the member."},
+		{"info", -1, "", 0, 0, 0, "server", cmdJupiter, "Returns information about a member, or the proxy's own counters with 'INFO jupiter'."},
+		{"config", -2, "admin", 0, 0, 0, "server", cmdJupiter, "Gets or sets the proxy's own settings."},
+		{"command", -1, "", 0, 0, 0, "server", cmdJupiter, "Returns detailed information about the commands supported by the proxy."},
+
+		// Scripting. Declared keys must be on the same member; SCRIPT LOAD and
+		// FUNCTION LOAD go to all members.
+		{"eval", -3, "noscript movablekeys", 0, 0, 0, "scripting", cmdProxied, "Executes a server-side Lua script."},
+		{"eval_ro", -3, "readonly noscript movablekeys", 0, 0, 0, "scripting", cmdProxied, "Executes a read-only server-side Lua script."},
+		{"evalsha", -3, "noscript movablekeys", 0, 0, 0, "scripting", cmdProxied, "Executes a server-side Lua script by SHA1 digest. Reloaded automatically into members that lost it."},
+		{"evalsha_ro", -3, "readonly noscript movablekeys", 0, 0, 0, "scripting", cmdProxied, "Executes a read-only server-side Lua script by SHA1 digest."},
+		{"fcall", -3, "noscript movablekeys", 0, 0, 0, "scripting", cmdProxied, "Invokes a function. Libraries are reloaded automatically into members that lost them."},
+		{"fcall_ro", -3, "readonly noscript movablekeys", 0, 0, 0, "scripting", cmdProxied, "Invokes a read-only function."},
+		{"script", -2, "noscript", 0, 0, 0, "scripting", cmdProxied, "A container for Lua scripts management commands. LOAD, FLUSH and KILL go to all members."},
+		{"function", -2, "noscript", 0, 0, 0, "scripting", cmdProxied, "A container for function commands. LOAD, DELETE, FLUSH, RESTORE and KILL go to all members."},
+
+		// Redis Cluster emulation; the proxy fleet is presented as a cluster where
+		// each proxy owns a range of slots.
+		{"cluster", -2, "", 0, 0, 0, "cluster", cmdJupiter, "Describes the proxy fleet as a Redis Cluster (INFO, MYID, SLOTS, SHARDS, NODES, KEYSLOT)."},
+		{"readonly", 1, "fast", 0, 0, 0, "cluster", cmdJupiter, "Accepted for cluster clients; does nothing."},
+		{"readwrite", 1, "fast", 0, 0, 0, "cluster", cmdJupiter, "Accepted for cluster clients; does nothing."},
+		{"asking", 1, "fast", 0, 0, 0, "cluster", cmdJupiter, "Accepted for cluster clients; does nothing."},
+
+		// Our own extensions.
+		{"distget", 2, "readonly", 1, 1, 1, "jupiter", cmdJupiter, "Returns a large value stored as 'key/0..n-1' chunks plus 'key/len', read in parallel by all proxies."},
+		{"distgetrange", 4, "readonly", 1, 1, 1, "jupiter", cmdJupiter, "Returns bytes start to end (inclusive; negative from the end) of a DISTSET value, reading only the chunks that cover them."},
+		{"distset", -3, "write", 1, 1, 1, "jupiter", cmdJupiter, "Stores a large value as 'key/0..n-1' chunks plus 'key/len', for DISTGET. Options: EX seconds, CHUNKSIZE bytes, LAYOUT hashed|spread."},
+		{"distdel", 2, "write", 1, 1, 1, "jupiter", cmdJupiter, "Removes a DISTSET value: 'key/len', then all its chunks."},
+		{"distexpire", 3, "write", 1, 1, 1, "jupiter", cmdJupiter, "Sets the TTL (seconds) of a DISTSET value's chunks and 'key/len'."},
+		{"distttl", 2, "readonly", 1, 1, 1, "jupiter", cmdJupiter, "Returns the lowest TTL (seconds) among a DISTSET value's keys; -2 if any is missing, -1 if none expire."},
+		{"distexists", 2, "readonly", 1, 1, 1, "jupiter", cmdJupiter, "Returns 1 if a DISTSET value's 'key/len' and all its chunks exist."},
+		{"jupiter.route", -2, "fast", 0, 0, 0, "jupiter", cmdJupiter, "Sets (HASH key), clears (CLEAR) or shows (INFO) the connection's sticky hash key; STRICT ON|OFF toggles parsing of trailing hash=/index= args."},
+		{"detach", 1, "", 0, 0, 0, "jupiter", cmdJupiter, "Detaches the connection from the proxy's command loop, then closes it."},
+
+		// Not supported; these need state on a single member connection, or
+		// keys that may live on several members.
+		{"multi", 1, "noscript fast", 0, 0, 0, "transactions", cmdUnsupported, "Starts a transaction."},
+		{"exec", 1, "noscript", 0, 0, 0, "transactions", cmdUnsupported, "Executes all commands in a transaction."},
+		{"discard", 1, "noscript fast", 0, 0, 0, "transactions", cmdUnsupported, "Discards a transaction."},
+		{"watch", -2, "noscript fast", 1, -1, 1, "transactions", cmdUnsupported, "Monitors changes to keys to determine the execution of a transaction."},
+		{"unwatch", 1, "noscript fast", 0, 0, 0, "transactions", cmdUnsupported, "Forgets about watched keys of a transaction."},
+		{"subscribe", -2, "pubsub noscript", 0, 0, 0, "pubsub", cmdUnsupported, "Listens for messages published to channels."},
+		{"psubscribe", -2, "pubsub noscript", 0, 0, 0, "pubsub", cmdUnsupported, "Listens for messages published to channels that match one or more patterns."},
+		{"unsubscribe", -1, "pubsub noscript", 0, 0, 0, "pubsub", cmdUnsupported, "Stops listening to messages posted to channels."},
+		{"punsubscribe", -1, "pubsub noscript", 0, 0, 0, "pubsub", cmdUnsupported, "Stops listening to messages published to channels that match one or more patterns."},
+		{"publish", 3, "pubsub fast", 0, 0, 0, "pubsub", cmdUnsupported, "Posts a message to a channel."},
+		{"select", 2, "fast", 0, 0, 0, "connection", cmdUnsupported, "Changes the selected database."},
+		{"swapdb", 3, "write fast", 0, 0, 0, "server", cmdUnsupported, "Swaps two Redis databases."},
+		{"client", -2, "", 0, 0, 0, "connection", cmdUnsupported, "A container for client connection commands."},
+		{"monitor", 1, "admin noscript", 0, 0, 0, "server", cmdUnsupported, "Listens for all requests received by the server in real-time."},
+		{"blpop", -3, "write noscript", 1, -2, 1, "list", cmdUnsupported, "Removes and returns the first element in a list. Blocks until an element is available otherwise."},
+		{"brpop", -3, "write noscript", 1, -2, 1, "list", cmdUnsupported, "Removes and returns the last element in a list. Blocks until an element is available otherwise."},
+	}
+
+	commandTable = func() map[string]*cmdInfo {
+		m := make(map[string]*cmdInfo)
+		for _, ci := range commandList {
+			m[ci.name] = ci
+		}
+
+		return m
+	}()
+)
+
+func writeCommandInfo(conn redcon.Conn, ci *cmdInfo) {
+	flags := strings.Fields(ci.flags)
+	if ci.support == cmdUnsupported {
+		flags = append(flags, "jupiter_unsupported")
+	}
+
+	conn.WriteArray(10)
+	conn.WriteBulkString(ci.name)
+	conn.WriteInt(ci.arity)
+	conn.WriteArray(len(flags))
+	for _, f := range flags {
+		conn.WriteString(f)
+	}
+
+	conn.WriteInt(ci.firstKey)
+	conn.WriteInt(ci.lastKey)
+	conn.WriteInt(ci.step)
+	cats := ci.aclCategories()
+	conn.WriteArray(len(cats))
+	for _, c := range cats {
+		conn.WriteString(c)
+	}
+
+	conn.WriteArray(0) // tips
+	conn.WriteArray(0) // key specs
+	conn.WriteArray(0) // subcommands
+}
+
+func writeCommandDocs(conn redcon.Conn, ci *cmdInfo) {
+	summary := ci.summary
+	switch ci.support {
+	case cmdUnsupported:
+		summary = "[not supported by jupiter] " + summary
+	case cmdJupiter:
+		summary = "[jupiter] " + summary
+	}
+
+	conn.WriteBulkString(ci.name)
+	conn.WriteArray(4)
+	conn.WriteBulkString("summary")
+	conn.WriteBulkString(summary)
+	conn.WriteBulkString("group")
+	conn.WriteBulkString(ci.group)
+}
+
+// commandCmd answers COMMAND [COUNT|LIST|INFO|DOCS] from our own command table,
+// instead of letting a random member describe itself.
+func commandCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) == 1 {
+		conn.WriteArray(len(commandList))
+		for _, ci := range commandList {
+			writeCommandInfo(conn, ci)
+		}
+
+		return
+	}
+
+	names := func() []string {
+		var s []string
+		for _, a := range cmd.Args[2:] {
+			s = append(s, strings.ToLower(string(a)))
+		}
+
+		return s
+	}
+
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "count":
+		conn.WriteInt(len(commandList))
+	case "list":
+		var l []string
+		for _, ci := range commandList {
+			l = append(l, ci.name)
+		}
+
+		sort.Strings(l)
+		conn.WriteArray(len(l))
+		for _, v := range l {
+			conn.WriteBulkString(v)
+		}
+	case "info":
+		n := names()
+		if len(n) == 0 {
+			commandCmd(conn, redcon.Command{Args: cmd.Args[:1]}, meta)
+			return
+		}
+
+		conn.WriteArray(len(n))
+		for _, v := range n {
+			if ci, ok := commandTable[v]; ok {
+				writeCommandInfo(conn, ci)
+			} else {
+				conn.WriteNull()
+			}
+		}
+	case "docs":
+		var l []*cmdInfo
+		n := names()
+		switch {
+		case len(n) == 0:
+			l = commandList
+		default:
+			for _, v := range n {
+				if ci, ok := commandTable[v]; ok {
+					l = append(l, ci) // unknown names are skipped, like Redis
+				}
+			}
+		}
+
+		conn.WriteArray(len(l) * 2)
+		for _, ci := range l {
+			writeCommandDocs(conn, ci)
+		}
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", cmd.Args[1]))
+	}
+}
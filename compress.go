@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/alphauslabs/jupiter/internal/compress"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"github.com/golang/glog"
+)
+
+var (
+	compressRules []compressRule // longest prefix first; set once, in main
+
+	compressedValues = metrics.Counter("compressed_values")
+	compressBytesIn  = metrics.Counter("compress_bytes_in")
+	compressBytesOut = metrics.Counter("compress_bytes_out")
+	decompressErrs   = metrics.Counter("decompress_errors")
+)
+
+type compressRule struct {
+	prefix string
+	codec  string
+}
+
+// setCompress parses -compress, fmt: {prefix}={codec}[,...].
+func setCompress(s string) error {
+	rules := []compressRule{}
+	for _, r := range strings.Split(s, ",") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+
+		prefix, codec, ok := strings.Cut(strings.TrimSpace(r), "=")
+		if !ok || !compress.Valid(codec) {
+			return fmt.Errorf("invalid -compress entry '%v', fmt: {prefix}={zstd|snappy}", r)
+		}
+
+		rules = append(rules, compressRule{prefix: prefix, codec: codec})
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	compressRules = rules
+	return nil
+}
+
+// compressCodec returns the codec for key, if any.
+func compressCodec(key string) string {
+	for _, r := range compressRules {
+		if strings.HasPrefix(key, r.prefix) {
+			return r.codec
+		}
+	}
+
+	return ""
+}
+
+// compressValue returns v as stored for key: compressed, if key has a rule
+// and v is at least -compressmin bytes, otherwise as is (see compress.Encode).
+// Values of keys without a rule are never touched, even if they look like
+// ours, so -compress doesn't change what other clients see.
+func compressValue(key string, v []byte) []byte {
+	codec := compressCodec(key)
+	if codec == "" {
+		return v
+	}
+
+	if len(v) < *flags.CompressMin {
+		codec = ""
+	}
+
+	out, ok := compress.Encode(codec, v)
+	if ok {
+		compressedValues.Add(1)
+		compressBytesIn.Add(int64(len(v)))
+		compressBytesOut.Add(int64(len(out)))
+	}
+
+	return out
+}
+
+// compressArgs returns args with the values of write commands passed through
+// compressValue. args itself is not modified.
+func compressArgs(args [][]byte) [][]byte {
+	if len(args) < 3 {
+		return args
+	}
+
+	var vals []int // indexes of values
+	var keys []int // ... and their keys
+	switch strings.ToLower(string(args[0])) {
+	case "set", "setnx", "getset":
+		vals, keys = []int{2}, []int{1}
+	case "setex", "psetex":
+		if len(args) == 4 {
+			vals, keys = []int{3}, []int{1}
+		}
+	case "mset", "msetnx":
+		for i := 2; i < len(args); i += 2 {
+			vals, keys = append(vals, i), append(keys, i-1)
+		}
+	case "hset", "hmset", "hsetnx":
+		for i := 3; i < len(args); i += 2 {
+			vals, keys = append(vals, i), append(keys, 1)
+		}
+	}
+
+	if len(vals) == 0 {
+		return args
+	}
+
+	out := make([][]byte, len(args))
+	copy(out, args)
+	for i, v := range vals {
+		out[v] = compressValue(string(args[keys[i]]), args[v])
+	}
+
+	return out
+}
+
+// decompressReply returns v with our compressed values decoded, for the
+// commands that return stored values; other replies are returned as is.
+func decompressReply(cmd string, v interface{}) interface{} {
+	switch strings.ToLower(cmd) {
+	case "get", "getex", "getdel", "getset", "set", "hget", "mget", "hmget", "hvals", "hgetall":
+	default:
+		return v
+	}
+
+	switch v := v.(type) {
+	case string:
+		return decompressString(v)
+	case []interface{}: // MGET, HMGET, HVALS, HGETALL (RESP2)
+		hgetall := strings.EqualFold(cmd, "hgetall")
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = e
+			if s, ok := e.(string); ok && (!hgetall || i%2 == 1) {
+				out[i] = decompressString(s)
+			}
+		}
+
+		return out
+	case map[interface{}]interface{}: // HGETALL (RESP3)
+		out := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			out[k] = e
+			if s, ok := e.(string); ok {
+				out[k] = decompressString(s)
+			}
+		}
+
+		return out
+	default:
+		return v
+	}
+}
+
+func decompressString(s string) string {
+	if !compress.EncodedString(s) {
+		return s
+	}
+
+	b, err := compress.Decode([]byte(s))
+	if err != nil {
+		decompressErrs.Add(1)
+		glog.Errorf("[decompress] %v", err)
+		return s
+	}
+
+	return string(b)
+}
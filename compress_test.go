@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alphauslabs/jupiter/internal/compress"
+	"github.com/alphauslabs/jupiter/internal/flags"
+)
+
+// withCompress sets -compress to s, and -compressmin to min, for t.
+func withCompress(t *testing.T, s string, min int) {
+	t.Helper()
+	rules, old := compressRules, *flags.CompressMin
+	t.Cleanup(func() { compressRules, *flags.CompressMin = rules, old })
+	if err := setCompress(s); err != nil {
+		t.Fatal(err)
+	}
+
+	*flags.CompressMin = min
+}
+
+func TestSetCompress(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		err bool
+	}{
+		{in: ""},
+		{in: "a/=zstd"},
+		{in: " a/=zstd , b/=snappy ,"},
+		{in: "=zstd"}, // all keys
+		{in: "a/", err: true},
+		{in: "a/=gzip", err: true},
+		{in: "a/=zstd,b/", err: true},
+	} {
+		rules := compressRules
+		err := setCompress(tc.in)
+		compressRules = rules
+		if (err != nil) != tc.err {
+			t.Errorf("setCompress(%q) error = %v, want error: %v", tc.in, err, tc.err)
+		}
+	}
+}
+
+func TestCompressCodec(t *testing.T) {
+	withCompress(t, "a/=snappy,a/b/=zstd,a/b/c/=snappy", 0)
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{"a/x", compress.Snappy},
+		{"a/b/x", compress.Zstd}, // longest prefix wins, whatever the order
+		{"a/b/c/x", compress.Snappy},
+		{"a/b", compress.Snappy},
+		{"b/a/x", ""},
+		{"", ""},
+	} {
+		if got := compressCodec(tc.key); got != tc.want {
+			t.Errorf("compressCodec(%q) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestCompressValue(t *testing.T) {
+	withCompress(t, "c/=zstd", 64)
+	long := strings.Repeat("jupiter ", 16)
+	magic := "\x00JPZ"
+	var distinct string
+	for c := byte('!'); len(distinct) < 80; c++ {
+		distinct += string(c)
+	}
+
+	for _, tc := range []struct {
+		key, in    string
+		compressed bool // has our header
+		same       bool // stored as is
+	}{
+		{key: "c/k", in: long, compressed: true},
+		{key: "c/k", in: "short", same: true},                  // under -compressmin
+		{key: "c/k", in: strings.Repeat("x", 63), same: true},  // just under
+		{key: "c/k", in: distinct, same: true},                 // doesn't shrink
+		{key: "c/k", in: magic + "zshort", compressed: true},   // escaped
+		{key: "c/k", in: magic + "r" + long, compressed: true}, // compressed anyway
+		{key: "k", in: long, same: true},                       // no rule
+		{key: "k", in: magic + "zshort", same: true},           // no rule, not escaped
+		{key: "k", in: magic + "r" + long, same: true},
+	} {
+		out := compressValue(tc.key, []byte(tc.in))
+		switch {
+		case tc.same && string(out) != tc.in:
+			t.Errorf("compressValue(%q, %q) = %q, want as is", tc.key, tc.in, out)
+		case tc.compressed && !compress.Encoded(out):
+			t.Errorf("compressValue(%q, %q) = %q, want a header", tc.key, tc.in, out)
+		case tc.compressed && decompressString(string(out)) != tc.in:
+			t.Errorf("compressValue(%q, %q) doesn't read back", tc.key, tc.in)
+		}
+	}
+}
+
+func TestCompressArgs(t *testing.T) {
+	withCompress(t, "c/=snappy", 0)
+	long := strings.Repeat("jupiter ", 16)
+	for _, tc := range []struct {
+		args []string
+		vals []int // indexes compressed
+	}{
+		{[]string{"SET", "c/k", long}, []int{2}},
+		{[]string{"set", "c/k", long, "EX", "10"}, []int{2}},
+		{[]string{"SET", "k", long}, nil},
+		{[]string{"SETEX", "c/k", "10", long}, []int{3}},
+		{[]string{"MSET", "c/a", long, "b", long, "c/c", long}, []int{2, 6}},
+		{[]string{"HSET", "c/h", "f1", long, "f2", long}, []int{3, 5}},
+		{[]string{"HSET", "h", "f1", long}, nil},
+		{[]string{"GET", "c/k"}, nil},
+		{[]string{"APPEND", "c/k", long}, nil},
+	} {
+		args := make([][]byte, len(tc.args))
+		for i, a := range tc.args {
+			args[i] = []byte(a)
+		}
+
+		out := compressArgs(args)
+		for i := range args {
+			if string(args[i]) != tc.args[i] {
+				t.Errorf("compressArgs(%v) modified its input", tc.args)
+			}
+
+			want := false
+			for _, v := range tc.vals {
+				want = want || v == i
+			}
+
+			if compress.Encoded(out[i]) != want {
+				t.Errorf("compressArgs(%v)[%v] compressed = %v, want %v", tc.args, i, !want, want)
+			}
+		}
+	}
+}
+
+func TestDecompressReply(t *testing.T) {
+	withCompress(t, "c/=zstd", 0)
+	long := strings.Repeat("jupiter ", 16)
+	enc := string(compressValue("c/k", []byte(long)))
+	for _, tc := range []struct {
+		cmd  string
+		in   interface{}
+		want interface{}
+	}{
+		{"GET", enc, long},
+		{"get", "plain", "plain"},
+		{"GET", nil, nil},
+		{"STRLEN", enc, enc}, // not one of ours
+		{"GETRANGE", enc, enc},
+		{"MGET", []interface{}{enc, nil, "plain"}, []interface{}{long, nil, "plain"}},
+		{"HMGET", []interface{}{nil, enc}, []interface{}{nil, long}},
+		{"HVALS", []interface{}{enc, enc}, []interface{}{long, long}},
+		{"HGETALL", []interface{}{enc, enc, "f", enc}, []interface{}{enc, long, "f", long}}, // fields as is
+		{"HGETALL", map[interface{}]interface{}{"f": enc, enc: "x"}, map[interface{}]interface{}{"f": long, enc: "x"}},
+		{"GET", int64(1), int64(1)},
+	} {
+		if got := decompressReply(tc.cmd, tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("decompressReply(%v, %q) = %q, want %q", tc.cmd, tc.in, got, tc.want)
+		}
+	}
+}
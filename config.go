@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	rl "github.com/alphauslabs/jupiter/internal/ratelimit"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// configParam is a jupiter setting exposed through CONFIG GET/SET. set parses
+// a value, and returns the function that applies it, so that CONFIG SET can
+// check all its values before applying any. A nil set means the value can
+// only be changed at startup (through its flag).
+type configParam struct {
+	get func() string
+	set func(string) (func(), error)
+}
+
+var configParams = map[string]configParam{
+	"maxactive":      {get: func() string { return fmt.Sprint(*flags.MaxActive) }},
+	"minrunners":     {get: func() string { return fmt.Sprint(*flags.MinRunners) }},
+	"runneridle":     {get: func() string { return flags.RunnerIdle.String() }},
+	"pipelinebatch":  {get: func() string { return fmt.Sprint(*flags.PipelineBatch) }},
+	"pipelinelinger": {get: func() string { return flags.PipelineLinger.String() }},
+	"queuesize":      {get: func() string { return fmt.Sprint(*flags.QueueSize) }},
+	"enqueuetimeout": {
+		get: func() string { return cluster.EnqueueTimeout().String() },
+		set: func(v string) (func(), error) {
+			d, err := configDuration(v)
+			if err != nil {
+				return nil, err
+			}
+
+			return func() { cluster.SetEnqueueTimeout(d) }, nil
+		},
+	},
+	"clientqueue":       {get: func() string { return fmt.Sprint(*flags.ClientQueue) }},
+	"partitions":        {get: func() string { return fmt.Sprint(*flags.Partitions) }},
+	"replicationfactor": {get: func() string { return fmt.Sprint(*flags.ReplicationFactor) }},
+	"readtimeout":       {get: func() string { return flags.ReadTimeout.String() }},
+	"writetimeout":      {get: func() string { return flags.WriteTimeout.String() }},
+	"pooltimeout":       {get: func() string { return flags.PoolTimeout.String() }},
+	"cmdtimeout": {
+		get: func() string { return cluster.CmdTimeout().String() },
+		set: func(v string) (func(), error) {
+			d, err := configDuration(v)
+			if err != nil {
+				return nil, err
+			}
+
+			return func() { cluster.SetCmdTimeout(d) }, nil
+		},
+	},
+	"autochunk":     {get: func() string { return fmt.Sprint(*flags.AutoChunk) }},
+	"compress":      {get: func() string { return *flags.Compress }},
+	"compressmin":   {get: func() string { return fmt.Sprint(*flags.CompressMin) }},
+	"coalesce":      {get: func() string { return *flags.Coalesce }},
+	"nearcache":     {get: func() string { return *flags.NearCache }},
+	"nearcachesize": {get: func() string { return fmt.Sprint(*flags.NearCacheSize) }},
+	"nearcachettl":  {get: func() string { return flags.NearCacheTTL.String() }},
+	"ratelimit": {
+		get: func() string {
+			r, _ := rl.Get()
+			return strconv.FormatFloat(r, 'f', -1, 64)
+		},
+		set: func(v string) (func(), error) {
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil || !validRate(r) {
+				return nil, fmt.Errorf("invalid rate %q", v)
+			}
+
+			return func() {
+				_, b := rl.Get()
+				rl.Set(r, b)
+			}, nil
+		},
+	},
+	"rateburst": {
+		get: func() string {
+			_, b := rl.Get()
+			return fmt.Sprint(b)
+		},
+		set: func(v string) (func(), error) {
+			b, err := strconv.Atoi(v)
+			if err != nil || b < 0 {
+				return nil, fmt.Errorf("invalid burst %q", v)
+			}
+
+			return func() {
+				r, _ := rl.Get()
+				rl.Set(r, b)
+			}, nil
+		},
+	},
+	"verbosity": { // glog's -v
+		get: func() string { return flag.Lookup("v").Value.String() },
+		set: func(v string) (func(), error) {
+			if _, err := strconv.ParseInt(v, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid verbosity %q", v)
+			}
+
+			return func() { flag.Lookup("v").Value.Set(v) }, nil
+		},
+	},
+
+	// Not ours (they belong to the members), but redis-benchmark asks for
+	// these on startup.
+	"save":       {get: func() string { return "" }},
+	"appendonly": {get: func() string { return "no" }},
+}
+
+// validRate returns true if r is a valid -ratelimit: finite, and not
+// negative (0 is unlimited).
+func validRate(r float64) bool { return r >= 0 && !math.IsInf(r, 1) }
+
+// configDuration parses v as a duration for CONFIG SET, i.e. 500ms, 2s; 0
+// disables the setting.
+func configDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+
+	return d, nil
+}
+
+func configCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'config' command")
+		return
+	}
+
+	sub := strings.ToLower(string(cmd.Args[1]))
+	dir := meta.directive
+	if sub == "get" && (dir.hash != "" || dir.index > 0 || dir.member != "" || dir.fanout) {
+		// Ask the member(s) instead; only when in this command's directive,
+		// not for the connection's sticky hash key (JUPITER.ROUTE HASH).
+		passthrough(conn, cmd, meta)
+		return
+	}
+
+	switch sub {
+	case "get":
+		configGet(conn, cmd)
+	case "set":
+		configSet(conn, cmd)
+	case "resetstat":
+		metrics.Reset()
+		conn.WriteString("OK")
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", cmd.Args[1]))
+	}
+}
+
+// CONFIG GET pattern [pattern ...]
+func configGet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		conn.WriteError("ERR wrong number of arguments for 'config|get' command")
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, p := range cmd.Args[2:] {
+		pattern := strings.ToLower(string(p))
+		for k := range configParams {
+			if match.Match(k, pattern) {
+				found[k] = true
+			}
+		}
+	}
+
+	names := []string{}
+	for k := range found {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	conn.WriteArray(len(names) * 2)
+	for _, k := range names {
+		conn.WriteBulkString(k)
+		conn.WriteBulkString(configParams[k].get())
+	}
+}
+
+// CONFIG SET name value [name value ...]
+//
+// All names and values are validated before anything is applied.
+func configSet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+		conn.WriteError("ERR wrong number of arguments for 'config|set' command")
+		return
+	}
+
+	for i := 2; i < len(cmd.Args); i += 2 {
+		name := strings.ToLower(string(cmd.Args[i]))
+		p, ok := configParams[name]
+		switch {
+		case !ok:
+			conn.WriteError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", name))
+			return
+		case p.set == nil:
+			conn.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name))
+			return
+		}
+	}
+
+	apply := []func(){}
+	for i := 2; i < len(cmd.Args); i += 2 {
+		name := strings.ToLower(string(cmd.Args[i]))
+		fn, err := configParams[name].set(string(cmd.Args[i+1]))
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err))
+			return
+		}
+
+		apply = append(apply, fn)
+	}
+
+	for _, fn := range apply {
+		fn()
+	}
+
+	conn.WriteString("OK")
+}
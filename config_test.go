@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	rl "github.com/alphauslabs/jupiter/internal/ratelimit"
+	"github.com/tidwall/redcon"
+)
+
+// testConn records the reply to a command; other redcon.Conn methods panic.
+type testConn struct {
+	redcon.Conn
+	reply string
+}
+
+func (c *testConn) WriteString(s string) { c.reply = s }
+func (c *testConn) WriteError(s string)  { c.reply = "-" + s }
+
+func testCommand(args ...string) redcon.Command {
+	cmd := redcon.Command{}
+	for _, a := range args {
+		cmd.Args = append(cmd.Args, []byte(a))
+	}
+
+	return cmd
+}
+
+func TestConfigSet(t *testing.T) {
+	cmdTimeout, enqueueTimeout := cluster.CmdTimeout(), cluster.EnqueueTimeout()
+	rate, burst := rl.Get()
+	t.Cleanup(func() {
+		cluster.SetCmdTimeout(cmdTimeout)
+		cluster.SetEnqueueTimeout(enqueueTimeout)
+		rl.Set(rate, burst)
+	})
+
+	type state struct {
+		cmdTimeout, enqueueTimeout time.Duration
+		burst                      int
+	}
+
+	for _, tc := range []struct {
+		args []string // after CONFIG SET
+		want string   // reply, or a substring of the error
+		then state    // from {1s, 100ms, 10}
+	}{
+		{[]string{"cmdtimeout", "2s"}, "OK", state{2 * time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"CmdTimeout", "0"}, "OK", state{0, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2s", "enqueuetimeout", "0", "rateburst", "5"}, "OK", state{2 * time.Second, 0, 5}},
+
+		// Nothing applied if anything fails.
+		{[]string{"cmdtimeout", "2s", "enqueuetimeout", "-1s"}, "argument 'enqueuetimeout'", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2s", "rateburst", "x"}, "invalid burst", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2s", "bogus", "1"}, "Unknown option", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2s", "maxactive", "10"}, "immutable", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2s", "save", ""}, "immutable", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2"}, "invalid duration", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"verbosity", "x"}, "invalid verbosity", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"ratelimit", "NaN", "rateburst", "5"}, "invalid rate", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"ratelimit", "+Inf"}, "invalid rate", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"ratelimit", "-1"}, "invalid rate", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"ratelimit", "1e400"}, "invalid rate", state{time.Second, 100 * time.Millisecond, 10}}, // out of range
+		{[]string{"ratelimit", "0.5", "rateburst", "5"}, "OK", state{time.Second, 100 * time.Millisecond, 5}},
+
+		// Malformed.
+		{[]string{"cmdtimeout"}, "wrong number of arguments", state{time.Second, 100 * time.Millisecond, 10}},
+		{[]string{"cmdtimeout", "2s", "enqueuetimeout"}, "wrong number of arguments", state{time.Second, 100 * time.Millisecond, 10}},
+	} {
+		cluster.SetCmdTimeout(time.Second)
+		cluster.SetEnqueueTimeout(100 * time.Millisecond)
+		rl.Set(0, 10)
+		conn := &testConn{}
+		configSet(conn, testCommand(append([]string{"CONFIG", "SET"}, tc.args...)...))
+		if tc.want == "OK" && conn.reply != "OK" || tc.want != "OK" && !strings.Contains(conn.reply, tc.want) {
+			t.Errorf("CONFIG SET %v = %q, want %q", tc.args, conn.reply, tc.want)
+		}
+
+		_, burst := rl.Get()
+		got := state{cluster.CmdTimeout(), cluster.EnqueueTimeout(), burst}
+		if got != tc.then {
+			t.Errorf("CONFIG SET %v left %+v, want %+v", tc.args, got, tc.then)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+)
+
+// directive is the parsed form of our optional routing arg, which should be
+// the last arg of a command. Grammar:
+//
+//	directive = [prefix] option *("," option)
+//	prefix    = "jupiter:"
+//	option    = name "=" value
+//	name      = "hash" | "index" | "len" | "layout" | "timeout" | "replica" | "fanout" | "member"
+//
+// where:
+//
+//	hash={key}      use {key} as hash key (chars not allowed: ,=)
+//	index={num}     0-based index in args to use as hash key (not 0, not the directive)
+//	len={n}         chunk count for DISTGET (and the other DIST* commands),
+//	                instead of querying 'key/len'
+//	layout={l}      chunk layout for DISTSET, and DIST* with len=: hashed|spread
+//	timeout={d}     deadline for this command, as a Go duration (i.e. 500ms, 2s)
+//	                or an integer in milliseconds
+//	replica=prefer  send read-only commands to the owner's replica, if any
+//	fanout=all      send the command to all members; reply is an array of
+//	                replies, in member order
+//	member={host}   send the command to this member (host:port)
+//
+// A last arg is only considered a directive if it starts with "hash=" or
+// "index=" (as it always has), or with the prefix followed by one of the
+// names above and '='. The newer options are common words, and values like
+// 'timeout=5' would be taken as directives, so they're only recognized after
+// either: i.e. 'hash=k,timeout=2s' or 'jupiter:timeout=2s'. Once the last arg
+// is a directive, any error in it is returned to the client instead of being
+// silently ignored.
+type directive struct {
+	hash    string
+	index   int
+	chunks  int
+	layout  string
+	timeout time.Duration
+	replica bool
+	fanout  bool
+	member  string
+}
+
+var directiveNames = map[string]bool{
+	"hash":    true,
+	"index":   true,
+	"len":     true,
+	"layout":  true,
+	"timeout": true,
+	"replica": true,
+	"fanout":  true,
+	"member":  true,
+}
+
+// directivePrefix is reserved for directives using any option first.
+const directivePrefix = "jupiter:"
+
+// isDirective returns true if s looks like a directive.
+func isDirective(s string) bool {
+	if strings.HasPrefix(s, "hash=") || strings.HasPrefix(s, "index=") {
+		return true
+	}
+
+	s, ok := strings.CutPrefix(s, directivePrefix)
+	if !ok {
+		return false
+	}
+
+	name, _, ok := strings.Cut(s, "=")
+	return ok && directiveNames[name]
+}
+
+// parseDirective parses s, assumed to have passed isDirective. The index
+// option is only checked for syntax here; its range depends on the command.
+func parseDirective(s string) (directive, error) {
+	var d directive
+	s = strings.TrimPrefix(s, directivePrefix)
+	seen := make(map[string]bool)
+	for _, opt := range strings.Split(s, ",") {
+		name, val, ok := strings.Cut(opt, "=")
+		switch {
+		case !ok:
+			return d, fmt.Errorf("ERR invalid directive option '%s', expected name=value", opt)
+		case !directiveNames[name]:
+			return d, fmt.Errorf("ERR unknown directive option '%s'", name)
+		case seen[name]:
+			return d, fmt.Errorf("ERR duplicate directive option '%s'", name)
+		case val == "":
+			return d, fmt.Errorf("ERR empty value for directive option '%s'", name)
+		}
+
+		seen[name] = true
+		switch name {
+		case "hash":
+			d.hash = val
+		case "index":
+			i, err := strconv.Atoi(val)
+			if err != nil || i <= 0 {
+				return d, fmt.Errorf("ERR invalid index '%s'", val)
+			}
+
+			d.index = i
+		case "len":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return d, fmt.Errorf("ERR invalid len '%s'", val)
+			}
+
+			d.chunks = n
+		case "layout":
+			if val != cluster.LayoutHashed && val != cluster.LayoutSpread {
+				return d, fmt.Errorf("ERR invalid layout '%s', expected 'hashed' or 'spread'", val)
+			}
+
+			d.layout = val
+		case "timeout":
+			t, err := parseTimeout(val)
+			if err != nil {
+				return d, fmt.Errorf("ERR invalid timeout '%s'", val)
+			}
+
+			d.timeout = t
+		case "replica":
+			if val != "prefer" {
+				return d, fmt.Errorf("ERR invalid replica '%s', expected 'prefer'", val)
+			}
+
+			d.replica = true
+		case "fanout":
+			if val != "all" {
+				return d, fmt.Errorf("ERR invalid fanout '%s', expected 'all'", val)
+			}
+
+			d.fanout = true
+		case "member":
+			d.member = val
+		}
+	}
+
+	// Only one way of choosing the target.
+	targets := []string{}
+	for _, n := range []string{"hash", "index", "fanout", "member"} {
+		if seen[n] {
+			targets = append(targets, n)
+		}
+	}
+
+	if len(targets) > 1 {
+		return d, fmt.Errorf("ERR directive options '%s' and '%s' can't be used together",
+			targets[0], targets[1])
+	}
+
+	if d.replica && (d.fanout || d.member != "") {
+		return d, fmt.Errorf("ERR directive option 'replica' can't be used with 'fanout' or 'member'")
+	}
+
+	return d, nil
+}
+
+func parseTimeout(v string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(v); err == nil {
+		if ms <= 0 {
+			return 0, fmt.Errorf("not positive")
+		}
+
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	t, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+
+	if t <= 0 {
+		return 0, fmt.Errorf("not positive")
+	}
+
+	return t, nil
+}
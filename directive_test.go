@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+)
+
+func TestIsDirective(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{"hash=k", true},
+		{"index=2", true},
+		{"hash=k,timeout=2s", true},
+		{"hash=", true}, // an error, but still ours
+		{"jupiter:timeout=2s", true},
+		{"jupiter:fanout=all", true},
+		{"jupiter:hash=k", true},
+		{"jupiter:bogus=1", false},
+		{"jupiter:", false},
+		{"jupiter:timeout", false},
+		{"timeout=5", false},
+		{"member=host:6379", false},
+		{"len=3", false},
+		{"fanout=all", false},
+		{"hashes=1", false},
+		{"value", false},
+		{"", false},
+	} {
+		if got := isDirective(tc.in); got != tc.want {
+			t.Errorf("isDirective(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseDirective(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want directive
+		err  string // substring of the error, if any
+	}{
+		// Valid, alone and combined.
+		{in: "hash=k", want: directive{hash: "k"}},
+		{in: "index=2", want: directive{index: 2}},
+		{in: "hash=k,len=4,layout=spread", want: directive{hash: "k", chunks: 4, layout: cluster.LayoutSpread}},
+		{in: "hash=k,timeout=200ms,replica=prefer", want: directive{hash: "k", timeout: 200 * time.Millisecond, replica: true}},
+		{in: "jupiter:fanout=all,timeout=2s", want: directive{fanout: true, timeout: 2 * time.Second}},
+		{in: "jupiter:member=10.0.0.1:6379", want: directive{member: "10.0.0.1:6379"}},
+		{in: "jupiter:index=1,layout=hashed", want: directive{index: 1, layout: cluster.LayoutHashed}},
+		{in: "jupiter:replica=prefer", want: directive{replica: true}},
+
+		// hash= and index= values.
+		{in: "hash=", err: "empty value for directive option 'hash'"},
+		{in: "index=0", err: "invalid index '0'"},
+		{in: "index=-1", err: "invalid index '-1'"},
+		{in: "index=x", err: "invalid index 'x'"},
+
+		// Malformed, unknown and duplicate options.
+		{in: "hash=k,len", err: "invalid directive option 'len'"},
+		{in: "hash=k,bogus=1", err: "unknown directive option 'bogus'"},
+		{in: "hash=k,hash=j", err: "duplicate directive option 'hash'"},
+		{in: "jupiter:timeout=1s,timeout=2s", err: "duplicate directive option 'timeout'"},
+
+		// Other values.
+		{in: "hash=k,len=0", err: "invalid len '0'"},
+		{in: "hash=k,layout=flat", err: "invalid layout 'flat'"},
+		{in: "jupiter:replica=always", err: "invalid replica 'always'"},
+		{in: "jupiter:fanout=some", err: "invalid fanout 'some'"},
+
+		// Conflicting targets.
+		{in: "hash=k,index=1", err: "'hash' and 'index' can't be used together"},
+		{in: "jupiter:member=h:1,fanout=all", err: "'fanout' and 'member' can't be used together"},
+		{in: "hash=k,member=h:1", err: "'hash' and 'member' can't be used together"},
+		{in: "jupiter:fanout=all,replica=prefer", err: "'replica' can't be used with 'fanout' or 'member'"},
+		{in: "jupiter:member=h:1,replica=prefer", err: "'replica' can't be used with 'fanout' or 'member'"},
+
+		// Timeouts.
+		{in: "jupiter:timeout=500", want: directive{timeout: 500 * time.Millisecond}},
+		{in: "jupiter:timeout=1m30s", want: directive{timeout: 90 * time.Second}},
+		{in: "jupiter:timeout=0", err: "invalid timeout '0'"},
+		{in: "jupiter:timeout=-5", err: "invalid timeout '-5'"},
+		{in: "jupiter:timeout=-1s", err: "invalid timeout '-1s'"},
+		{in: "jupiter:timeout=soon", err: "invalid timeout 'soon'"},
+	} {
+		got, err := parseDirective(tc.in)
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseDirective(%q) error = %v, want %q", tc.in, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("parseDirective(%q) failed: %v", tc.in, err)
+		case !reflect.DeepEqual(got, tc.want):
+			t.Errorf("parseDirective(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
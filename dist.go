@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	goredisv9 "github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	distWriters = 16 // max chunks written in parallel per DISTSET
+	distProbe   = 64 // chunk ids tried per round by DISTDEL, without a manifest
+)
+
+var (
+	errNoChunks = errors.New("ERR no chunks found")
+	errChecksum = errors.New("ERR checksum mismatch in chunk")
+	errManifest = errors.New("ERR invalid")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// distSetCmd is the write side of distGetCmd, fmt:
+//
+//	DISTSET key value [EX seconds] [CHUNKSIZE bytes] [LAYOUT hashed|spread]
+//
+// The value is split into 'key/0..n-1' chunks, then 'key/len' is set to its
+// manifest (see distManifest). CHUNKSIZE defaults to -chunksize, LAYOUT
+// to the layout= directive, then -chunklayout.
+func distSetCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	var line string
+	defer func(begin time.Time, m *string) {
+		if *m != "" {
+			glog.Infof("[distSetCmd] %v, took %v", *m, time.Since(begin))
+		}
+	}(time.Now(), &line)
+
+	if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+		conn.WriteError("ERR wrong number of arguments for 'distset' command")
+		return
+	}
+
+	var ttl time.Duration
+	size := *flags.ChunkSize
+	layout := meta.layout
+	if layout == "" {
+		layout = *flags.ChunkLayout
+	}
+
+	for i := 3; i < len(cmd.Args); i += 2 {
+		opt := strings.ToLower(string(cmd.Args[i]))
+		if opt == "layout" {
+			layout = strings.ToLower(string(cmd.Args[i+1]))
+			if layout != cluster.LayoutHashed && layout != cluster.LayoutSpread {
+				conn.WriteError("ERR invalid layout, expected 'hashed' or 'spread'")
+				return
+			}
+
+			continue
+		}
+
+		n, err := strconv.Atoi(string(cmd.Args[i+1]))
+		switch {
+		case opt != "ex" && opt != "chunksize":
+			conn.WriteError("ERR syntax error")
+			return
+		case err != nil || n <= 0:
+			conn.WriteError(fmt.Sprintf("ERR invalid %v", opt))
+			return
+		case opt == "ex":
+			ttl = time.Duration(n) * time.Second
+		default:
+			size = n
+		}
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1])
+	m, err := meta.this.distSet(ctx, nkey, cmd.Args[2], ttl, size, layout)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+
+	line = fmt.Sprintf("key=%v, chunks=%v, len=%v, layout=%v", nkey, m.Chunks, len(cmd.Args[2]), layout)
+	conn.WriteString("OK")
+}
+
+// distSet writes value as chunks of size bytes for distGet. The order is
+// chunks first, then the manifest in 'nkey/len', so readers never see a
+// manifest with missing chunks, then the chunks of the previous version that
+// are no longer used (it was larger, or had another layout) are removed. All
+// keys get the same ttl (none if zero). Returns the manifest.
+func (p *proxy) distSet(ctx context.Context, nkey string, value []byte, ttl time.Duration, size int, layout string) (*distManifest, error) {
+	keyLen := fmt.Sprintf("%v/len", nkey)
+	old, err := p.readManifest(ctx, nkey)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := (len(value) + size - 1) / size
+	if chunks == 0 {
+		chunks = 1 // empty value, still readable
+	}
+
+	m := distManifest{
+		Chunks:    chunks,
+		Size:      int64(len(value)),
+		ChunkSize: size,
+		Layout:    layout,
+		CRC32C:    make([]uint32, chunks),
+		Total:     crc32.Checksum(value, crc32c),
+		Version:   uuid.NewString(),
+	}
+
+	set := func(key string, v []byte) [][]byte {
+		args := [][]byte{[]byte("SET"), []byte(key), v}
+		if ttl > 0 {
+			args = append(args, []byte("PX"), []byte(fmt.Sprint(ttl.Milliseconds())))
+		}
+
+		return args
+	}
+
+	var w sync.WaitGroup
+	var mtx sync.Mutex
+	var errs []error
+	sem := make(chan struct{}, distWriters)
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * size
+		if end > len(value) {
+			end = len(value)
+		}
+
+		m.CRC32C[i] = crc32.Checksum(value[i*size:end], crc32c)
+		w.Add(1)
+		sem <- struct{}{}
+		go func(i int, v []byte) {
+			defer func() {
+				<-sem
+				w.Done()
+			}()
+
+			host := p.cluster.ChunkOwner(nkey, i, layout)
+			_, err := p.cluster.DoMember(ctx, host, set(cluster.ChunkKey(nkey, i), compressValue(nkey, v)))
+			if err != nil {
+				mtx.Lock()
+				errs = append(errs, err)
+				mtx.Unlock()
+			}
+		}(i, value[i*size:end])
+	}
+
+	w.Wait()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("ERR write chunks failed: %w", errs[0])
+	}
+
+	b, _ := json.Marshal(m)
+	_, err = p.cluster.Do(ctx, keyLen, set(keyLen, b))
+	if err != nil {
+		return nil, fmt.Errorf("ERR write %v failed: %w", keyLen, err)
+	}
+
+	// Stale: beyond the new count, or in the same slot but on another member.
+	stale := make(map[string][][]byte)
+	for i := 0; i < old.Chunks; i++ {
+		host := p.cluster.ChunkOwner(nkey, i, old.Layout)
+		if i < chunks && host == p.cluster.ChunkOwner(nkey, i, layout) {
+			continue
+		}
+
+		if _, ok := stale[host]; !ok {
+			stale[host] = [][]byte{[]byte("DEL")}
+		}
+
+		stale[host] = append(stale[host], []byte(cluster.ChunkKey(nkey, i)))
+	}
+
+	for host, del := range stale {
+		// Not fatal; the new version is already complete.
+		if _, err := p.cluster.DoMember(ctx, host, del); err != nil {
+			glog.Errorf("[distSet] delete stale chunks of %v in %v failed: %v", nkey, host, err)
+		}
+	}
+
+	return &m, nil
+}
+
+// distManifest describes a DISTSET value; stored as JSON in 'key/len'.
+// Checksums are CRC-32C (Castagnoli). Values written before manifests have
+// 'n' or 'n {layout}' instead, which we still read, with no checksums.
+type distManifest struct {
+	Chunks    int      `json:"chunks"`
+	Size      int64    `json:"size"`
+	ChunkSize int      `json:"chunksize"`
+	Layout    string   `json:"layout"`
+	CRC32C    []uint32 `json:"crc32c"`
+	Total     uint32   `json:"total"`
+	Version   string   `json:"version"`
+}
+
+// valid returns true if m is a consistent manifest, with checksums.
+func (m *distManifest) valid() bool {
+	switch {
+	case m.Chunks <= 0, len(m.CRC32C) != m.Chunks, m.ChunkSize <= 0:
+		return false
+	case m.Size < 0, m.Size > int64(m.Chunks)*int64(m.ChunkSize):
+		return false
+	case m.Layout != cluster.LayoutHashed && m.Layout != cluster.LayoutSpread && m.Layout != "":
+		return false
+	}
+
+	return true
+}
+
+// verified returns true if m has checksums.
+func (m *distManifest) verified() bool { return len(m.CRC32C) > 0 }
+
+// chunkLen returns the expected size of chunk i, if m is verified.
+func (m *distManifest) chunkLen(i int) int64 {
+	n := m.Size - int64(i)*int64(m.ChunkSize)
+	if n > int64(m.ChunkSize) {
+		n = int64(m.ChunkSize)
+	}
+
+	return n
+}
+
+// check returns an error if chunk i doesn't match m.
+func (m *distManifest) check(i int, b []byte) error {
+	if !m.verified() {
+		return nil
+	}
+
+	if int64(len(b)) != m.chunkLen(i) || crc32.Checksum(b, crc32c) != m.CRC32C[i] {
+		return fmt.Errorf("%w [%v]", errChecksum, i)
+	}
+
+	return nil
+}
+
+// readManifest returns the manifest in 'nkey/len'. Chunks is zero if there's
+// none.
+func (p *proxy) readManifest(ctx context.Context, nkey string) (*distManifest, error) {
+	keyLen := fmt.Sprintf("%v/len", nkey) // no hash={key} used for '/len'
+	r, err := p.cluster.Do(ctx, keyLen, [][]byte{[]byte("GET"), []byte(keyLen)})
+	switch {
+	case errors.Is(err, goredisv9.Nil):
+		return &distManifest{Layout: cluster.LayoutHashed}, nil
+	case err != nil:
+		return nil, fmt.Errorf("ERR %w", err)
+	}
+
+	s, _ := r.(string)
+	m := &distManifest{}
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), m); err != nil {
+			return nil, fmt.Errorf("%w %v: %w", errManifest, keyLen, err)
+		}
+
+		if !m.valid() {
+			return nil, fmt.Errorf("%w %v: inconsistent manifest", errManifest, keyLen)
+		}
+	} else { // legacy
+		ns, layout, _ := strings.Cut(s, " ")
+		m.Chunks, err = strconv.Atoi(ns)
+		if err != nil {
+			return nil, fmt.Errorf("%w %v: %w", errManifest, keyLen, err)
+		}
+
+		m.Layout = layout
+	}
+
+	switch m.Layout {
+	case "":
+		m.Layout = cluster.LayoutHashed
+	case cluster.LayoutHashed, cluster.LayoutSpread:
+	default:
+		return nil, fmt.Errorf("%w %v: unknown layout '%v'", errManifest, keyLen, m.Layout)
+	}
+
+	return m, nil
+}
+
+// Scripts for DISTEXPIRE and DISTTTL (and autoChunkExpire), run once per
+// member with all of its keys of the value as KEYS.
+var (
+	// ARGV: ttl (ms), or -1 to remove it. Returns the number of keys updated.
+	distExpireScript = `local n = 0
+for _, k in ipairs(KEYS) do
+  if tonumber(ARGV[1]) < 0 then n = n + redis.call('PERSIST', k) else n = n + redis.call('PEXPIRE', k, ARGV[1]) end
+end
+return n`
+
+	// Returns the PTTL of each key, in order.
+	distTTLScript = `local t = {}
+for i, k in ipairs(KEYS) do t[i] = redis.call('PTTL', k) end
+return t`
+)
+
+// distDelCmd removes a DISTSET value, fmt:
+//
+//	DISTDEL key
+//
+// 'key/len' goes first, so readers don't see partial values, then all chunks.
+// If 'key/len' can't be read (and len= isn't set), chunks are found by
+// probing instead (see distProbeDel). Replies 1 if the value existed, 0
+// otherwise.
+func distDelCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'distdel' command")
+		return
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1])
+	n, layout, err := meta.this.distCount(ctx, nkey, meta)
+	probe := errors.Is(err, errManifest)
+	switch {
+	case probe:
+		glog.Warningf("[distDelCmd] %v, probing for chunks", err)
+	case err != nil:
+		conn.WriteError(err.Error())
+		return
+	}
+
+	keyLen := fmt.Sprintf("%v/len", nkey)
+	r, err := meta.this.cluster.Do(ctx, keyLen, [][]byte{[]byte("DEL"), []byte(keyLen)})
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	deleted, _ := r.(int64)
+	var chunks int64
+	if probe {
+		chunks, err = meta.this.distProbeDel(ctx, nkey)
+	} else {
+		chunks, err = meta.this.distDel(ctx, meta.this.distOwners(nkey, n, layout, false))
+	}
+
+	deleted += chunks
+
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR delete chunks failed: %v", err))
+		return
+	}
+
+	if deleted > 0 {
+		conn.WriteInt(1)
+		return
+	}
+
+	conn.WriteInt(0)
+}
+
+// distExpireCmd sets the TTL of a DISTSET value, fmt:
+//
+//	DISTEXPIRE key seconds
+//
+// Replies 1 if the value exists, 0 otherwise.
+func distExpireCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'distexpire' command")
+		return
+	}
+
+	secs, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil || secs <= 0 {
+		conn.WriteError("ERR invalid expire time in 'distexpire' command")
+		return
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1])
+	n, layout, err := meta.this.distCount(ctx, nkey, meta)
+	switch {
+	case err != nil:
+		conn.WriteError(err.Error())
+		return
+	case n == 0:
+		conn.WriteInt(0)
+		return
+	}
+
+	var updated int64
+	ms := fmt.Sprint(secs * 1000)
+	err = meta.this.distEach(ctx, meta.this.distOwners(nkey, n, layout, true),
+		func(host string, keys []string) error {
+			r, err := meta.this.distEval(ctx, host, distExpireScript, keys, ms)
+			v, _ := r.(int64)
+			atomic.AddInt64(&updated, v)
+			return err
+		},
+	)
+
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR expire failed: %v", err))
+		return
+	}
+
+	if updated > 0 {
+		conn.WriteInt(1)
+		return
+	}
+
+	conn.WriteInt(0)
+}
+
+// distTTLCmd returns the TTL (seconds) of a DISTSET value, fmt:
+//
+//	DISTTTL key
+//
+// That is the lowest TTL among all its keys, as the value can't be read once
+// any of them expires. Same as TTL, -2 if the value (or any of its chunks)
+// doesn't exist, -1 if it has no TTL.
+func distTTLCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'distttl' command")
+		return
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1])
+	n, layout, err := meta.this.distCount(ctx, nkey, meta)
+	switch {
+	case err != nil:
+		conn.WriteError(err.Error())
+		return
+	case n == 0:
+		conn.WriteInt(-2)
+		return
+	}
+
+	var mtx sync.Mutex
+	ttl := int64(-1)
+	err = meta.this.distEach(ctx, meta.this.distOwners(nkey, n, layout, meta.chunks == 0),
+		func(host string, keys []string) error {
+			r, err := meta.this.distEval(ctx, host, distTTLScript, keys)
+			if err != nil {
+				return err
+			}
+
+			l, _ := r.([]interface{})
+			mtx.Lock()
+			defer mtx.Unlock()
+			for _, e := range l {
+				v, _ := e.(int64)
+				switch {
+				case v == -2 || ttl == -2:
+					ttl = -2
+				case v >= 0 && (ttl < 0 || v < ttl):
+					ttl = v
+				}
+			}
+
+			return nil
+		},
+	)
+
+	switch {
+	case err != nil:
+		conn.WriteError(fmt.Sprintf("ERR ttl failed: %v", err))
+	case ttl < 0:
+		conn.WriteInt64(ttl)
+	default:
+		conn.WriteInt64((ttl + 500) / 1000) // rounded, same as TTL
+	}
+}
+
+// distExistsCmd checks a DISTSET value, fmt:
+//
+//	DISTEXISTS key
+//
+// Replies 1 if 'key/len' (unless len= is used) and all chunks exist, 0
+// otherwise.
+func distExistsCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'distexists' command")
+		return
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1])
+	n, layout, err := meta.this.distCount(ctx, nkey, meta)
+	switch {
+	case err != nil:
+		conn.WriteError(err.Error())
+		return
+	case n == 0:
+		conn.WriteInt(0)
+		return
+	}
+
+	var found int64
+	owners := meta.this.distOwners(nkey, n, layout, false) // 'key/len' already checked
+	err = meta.this.distEach(ctx, owners, func(host string, keys []string) error {
+		args := [][]byte{[]byte("EXISTS")}
+		for _, k := range keys {
+			args = append(args, []byte(k))
+		}
+
+		r, err := meta.this.cluster.DoMember(ctx, host, args)
+		v, _ := r.(int64)
+		atomic.AddInt64(&found, v)
+		return err
+	})
+
+	switch {
+	case err != nil:
+		conn.WriteError(fmt.Sprintf("ERR exists failed: %v", err))
+	case found == int64(n):
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
+	}
+}
+
+// distCount returns the chunk count and layout of nkey, from the len= and
+// layout= directives, if set, or from 'nkey/len'.
+func (p *proxy) distCount(ctx context.Context, nkey string, meta metaT) (int, string, error) {
+	if meta.chunks > 0 {
+		layout := meta.layout
+		if layout == "" {
+			layout = cluster.LayoutHashed
+		}
+
+		return meta.chunks, layout, nil
+	}
+
+	m, err := p.readManifest(ctx, nkey)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return m.Chunks, m.Layout, nil
+}
+
+// distDel deletes the keys in owners, and returns how many existed.
+func (p *proxy) distDel(ctx context.Context, owners map[string][]string) (int64, error) {
+	var deleted int64
+	err := p.distEach(ctx, owners, func(host string, keys []string) error {
+		args := [][]byte{[]byte("DEL")}
+		for _, k := range keys {
+			args = append(args, []byte(k))
+		}
+
+		r, err := p.cluster.DoMember(ctx, host, args)
+		v, _ := r.(int64)
+		atomic.AddInt64(&deleted, v)
+		return err
+	})
+
+	return deleted, err
+}
+
+// distProbeDel deletes the chunks of nkey when their count and layout are
+// unknown: distProbe ids at a time, under both layouts, until a round finds
+// none. Returns how many existed.
+func (p *proxy) distProbeDel(ctx context.Context, nkey string) (int64, error) {
+	var deleted int64
+	for i := 0; ; i += distProbe {
+		owners := make(map[string][]string)
+		for j := i; j < i+distProbe; j++ {
+			k := cluster.ChunkKey(nkey, j)
+			hashed := p.cluster.ChunkOwner(nkey, j, cluster.LayoutHashed)
+			spread := p.cluster.ChunkOwner(nkey, j, cluster.LayoutSpread)
+			owners[hashed] = append(owners[hashed], k)
+			if spread != hashed {
+				owners[spread] = append(owners[spread], k)
+			}
+		}
+
+		n, err := p.distDel(ctx, owners)
+		deleted += n
+		if err != nil || n == 0 {
+			return deleted, err
+		}
+	}
+}
+
+// distOwners groups the keys of nkey's n chunks (and 'nkey/len', if withLen)
+// by owner member.
+func (p *proxy) distOwners(nkey string, n int, layout string, withLen bool) map[string][]string {
+	owners := make(map[string][]string)
+	if withLen {
+		keyLen := fmt.Sprintf("%v/len", nkey)
+		host := p.cluster.Locate(keyLen)
+		owners[host] = append(owners[host], keyLen)
+	}
+
+	for i := 0; i < n; i++ {
+		host := p.cluster.ChunkOwner(nkey, i, layout)
+		owners[host] = append(owners[host], cluster.ChunkKey(nkey, i))
+	}
+
+	return owners
+}
+
+// distEach calls fn for each member in owners in parallel, and returns the
+// first error, if any.
+func (p *proxy) distEach(ctx context.Context, owners map[string][]string, fn func(host string, keys []string) error) error {
+	var w sync.WaitGroup
+	var mtx sync.Mutex
+	var errs []error
+	for host, keys := range owners {
+		w.Add(1)
+		go func(host string, keys []string) {
+			defer w.Done()
+			if err := fn(host, keys); err != nil {
+				mtx.Lock()
+				errs = append(errs, err)
+				mtx.Unlock()
+			}
+		}(host, keys)
+	}
+
+	w.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// distEval runs script in host with keys as KEYS, loading it first if the
+// member doesn't have it yet.
+func (p *proxy) distEval(ctx context.Context, host, script string, keys []string, argv ...string) (interface{}, error) {
+	args := [][]byte{[]byte("EVALSHA"), []byte(cluster.ScriptSha1(script)), []byte(fmt.Sprint(len(keys)))}
+	for _, k := range keys {
+		args = append(args, []byte(k))
+	}
+
+	for _, v := range argv {
+		args = append(args, []byte(v))
+	}
+
+	v, err := p.cluster.DoMember(ctx, host, args)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		args[0], args[1] = []byte("EVAL"), []byte(script)
+		v, err = p.cluster.DoMember(ctx, host, args)
+	}
+
+	return v, err
+}
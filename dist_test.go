@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+)
+
+func TestCRC32C(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint32
+	}{
+		{"", 0},
+		{"123456789", 0xe3069283}, // the check value of CRC-32C
+		{"a", 0xc1d04330},
+	} {
+		if got := crc32.Checksum([]byte(tc.in), crc32c); got != tc.want {
+			t.Errorf("crc32c(%q) = %#x, want %#x", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDistManifestValid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		m    distManifest
+		want bool
+	}{
+		{"ok", distManifest{Chunks: 2, Size: 15, ChunkSize: 10, CRC32C: []uint32{1, 2}}, true},
+		{"full", distManifest{Chunks: 2, Size: 20, ChunkSize: 10, CRC32C: []uint32{1, 2}}, true},
+		{"spread", distManifest{Chunks: 1, Size: 1, ChunkSize: 10, CRC32C: []uint32{1}, Layout: cluster.LayoutSpread}, true},
+		{"hashed", distManifest{Chunks: 1, Size: 1, ChunkSize: 10, CRC32C: []uint32{1}, Layout: cluster.LayoutHashed}, true},
+		{"no chunks", distManifest{ChunkSize: 10}, false},
+		{"negative chunks", distManifest{Chunks: -1, ChunkSize: 10}, false},
+		{"missing checksums", distManifest{Chunks: 2, Size: 15, ChunkSize: 10, CRC32C: []uint32{1}}, false},
+		{"extra checksums", distManifest{Chunks: 1, Size: 5, ChunkSize: 10, CRC32C: []uint32{1, 2}}, false},
+		{"no chunk size", distManifest{Chunks: 1, Size: 5, CRC32C: []uint32{1}}, false},
+		{"negative size", distManifest{Chunks: 1, Size: -1, ChunkSize: 10, CRC32C: []uint32{1}}, false},
+		{"too large", distManifest{Chunks: 2, Size: 21, ChunkSize: 10, CRC32C: []uint32{1, 2}}, false},
+		{"unknown layout", distManifest{Chunks: 1, Size: 5, ChunkSize: 10, CRC32C: []uint32{1}, Layout: "flat"}, false},
+	} {
+		if got := tc.m.valid(); got != tc.want {
+			t.Errorf("%v: valid() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDistManifestCheck(t *testing.T) {
+	sum := func(s string) uint32 { return crc32.Checksum([]byte(s), crc32c) }
+	m := &distManifest{
+		Chunks:    3,
+		Size:      25,
+		ChunkSize: 10,
+		CRC32C:    []uint32{sum("0123456789"), sum("abcdefghij"), sum("ABCDE")},
+	}
+
+	for _, tc := range []struct {
+		m   *distManifest
+		i   int
+		in  string
+		err bool
+	}{
+		{m, 0, "0123456789", false},
+		{m, 1, "abcdefghij", false},
+		{m, 2, "ABCDE", false}, // last one, short
+		{m, 0, "0123456788", true},
+		{m, 1, "0123456789", true}, // someone else's
+		{m, 2, "ABCDEF", true},     // checksum aside, too long
+		{m, 2, "ABCD", true},
+		{m, 0, "", true},
+		{&distManifest{Chunks: 3}, 1, "anything", false}, // legacy, no checksums
+	} {
+		err := tc.m.check(tc.i, []byte(tc.in))
+		if (err != nil) != tc.err {
+			t.Errorf("check(%v, %q) = %v, want error: %v", tc.i, tc.in, err, tc.err)
+		}
+
+		if err != nil && !errors.Is(err, errChecksum) {
+			t.Errorf("check(%v, %q) = %v, want errChecksum", tc.i, tc.in, err)
+		}
+	}
+}
+
+func TestDistManifestChunkLen(t *testing.T) {
+	m := &distManifest{Chunks: 3, Size: 25, ChunkSize: 10}
+	for i, want := range []int64{10, 10, 5} {
+		if got := m.chunkLen(i); got != want {
+			t.Errorf("chunkLen(%v) = %v, want %v", i, got, want)
+		}
+	}
+}
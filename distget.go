@@ -0,0 +1,873 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	v1 "github.com/alphauslabs/jupiter/proto/v1"
+	"github.com/golang/glog"
+	"github.com/tidwall/redcon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// distFrame is the max chunk data per DistributedGet message.
+const distFrame = 1 << 20
+
+var (
+	distRetries   = metrics.Counter("distget_retries")
+	distRecovered = metrics.Counter("distget_recovered_chunks")
+
+	distChecksumErrs = metrics.Counter("distget_checksum_errors")
+)
+
+// distSink receives the output of distGet: the total size first, then the
+// chunks, in order.
+type distSink interface {
+	Begin(size int64) error
+	io.Writer
+}
+
+// respSink writes distGet's output to a RESP client as one bulk string,
+// flushing after each chunk.
+type respSink struct {
+	conn    redcon.Conn
+	started bool
+}
+
+func (s *respSink) Begin(size int64) error {
+	s.started = true
+	s.conn.WriteRaw([]byte(fmt.Sprintf("$%d\r\n", size)))
+	return nil
+}
+
+func (s *respSink) Write(b []byte) (int, error) {
+	s.conn.WriteRaw(b)
+	if bw := redcon.BaseWriter(s.conn); bw != nil {
+		if err := bw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// distGetCmd is a very naive implementation of a distributed GET. It tries to get
+// the current list of active nodes (not Redis) in the cluster, distribute the GET
+// load to all of them (including the node that received the call), and wait for
+// all responses. Trouble is, this is deployed as a Deployment in k8s, where pods
+// are quite volatile, so chances of pods not being available at call time, or
+// disappearing mid processing is quite high. Probably need to look at deploying
+// this as MIGs in GCP, that could be a slightly more stable environment for this
+// kind of load distribution. At the moment, the HPA for this deployment is set
+// with min = max, so at least the scale up/down is relatively fixed.
+func distGetCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	var line string
+	defer func(begin time.Time, m *string) {
+		if *m != "" {
+			glog.Infof("[distGetCmd] %v, took %v", *m, time.Since(begin))
+		}
+	}(time.Now(), &line)
+
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR invalid args")
+		return
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1]) // 'key' arg not used here
+	sink := &respSink{conn: conn}
+	chunks, err := meta.this.distGet(ctx, nkey, meta.chunks, meta.layout, sink)
+	switch {
+	case err != nil && sink.started:
+		// Mid-reply; all we can do is drop the connection.
+		glog.Errorf("[distGetCmd] %v failed mid-stream: %v", nkey, err)
+		conn.Close()
+		return
+	case err != nil:
+		conn.WriteError(err.Error())
+		return
+	}
+
+	conn.WriteRaw([]byte("\r\n"))
+	line = fmt.Sprintf("key=%v, chunks=%v", nkey, chunks)
+}
+
+// distGetRangeCmd is GETRANGE for DISTSET values, fmt:
+//
+//	DISTGETRANGE key start end
+//
+// Only the chunks that cover the range are read.
+func distGetRangeCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	var line string
+	defer func(begin time.Time, m *string) {
+		if *m != "" {
+			glog.Infof("[distGetRangeCmd] %v, took %v", *m, time.Since(begin))
+		}
+	}(time.Now(), &line)
+
+	if len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'distgetrange' command")
+		return
+	}
+
+	start, err1 := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	end, err2 := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+	if err1 != nil || err2 != nil {
+		conn.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+
+	ctx, cancel := meta.context()
+	defer cancel()
+	nkey := string(cmd.Args[1])
+	sink := &respSink{conn: conn}
+	chunks, err := meta.this.distGetRange(ctx, nkey, meta.chunks, meta.layout, start, end, sink)
+	switch {
+	case err != nil && sink.started:
+		glog.Errorf("[distGetRangeCmd] %v failed mid-stream: %v", nkey, err)
+		conn.Close()
+		return
+	case err != nil:
+		conn.WriteError(err.Error())
+		return
+	}
+
+	conn.WriteRaw([]byte("\r\n"))
+	line = fmt.Sprintf("key=%v, range=%v-%v, chunks=%v", nkey, start, end, chunks)
+}
+
+// distGet does the actual distributed GET of nkey for distGetCmd (and our
+// other front-ends). If chunks is zero, the manifest is read from 'nkey/len';
+// otherwise, layout is used as is, with no checksums. Returns the number of
+// chunks.
+//
+// Chunk reads are assigned to all proxies in the fleet, which stream them
+// back through their DistributedGet rpc (we read ours directly). Proxies that
+// fail, disappear, or stay silent (see distPeerTimeout) before sending their
+// header, and chunks they couldn't read, are reassigned to the proxies that
+// did reply, up to -distretries times, then read by us, as a last resort.
+// Once all sizes are known, w gets the total, then the chunks, in order, as
+// they arrive.
+//
+// Chunks that don't match the manifest (i.e. overwritten by a concurrent
+// DISTSET) fail the read; if nothing was written to w yet, the whole read is
+// retried, with a fresh manifest, up to -distretries times.
+func (p *proxy) distGet(ctx context.Context, nkey string, chunks int, layout string, w distSink) (int, error) {
+	return p.distGetRange(ctx, nkey, chunks, layout, 0, -1, w)
+}
+
+// distGetRange is distGet for bytes start to end (inclusive; negative values
+// are from the end, same as GETRANGE), fetching only the chunks that cover
+// them. The whole value is read as is, without resolving its size, when
+// start is 0 and end is -1.
+func (p *proxy) distGetRange(ctx context.Context, nkey string, chunks int, layout string, start, end int64, w distSink) (int, error) {
+	for attempt := 0; ; attempt++ {
+		m := &distManifest{Chunks: chunks, Layout: layout}
+		if chunks == 0 { // try getting it ourselves
+			var err error
+			m, err = p.readManifest(ctx, nkey)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if m.Chunks == 0 { // if still none
+			return 0, errNoChunks
+		}
+
+		lo, hi := 0, m.Chunks-1
+		sink := w
+		if start != 0 || end != -1 {
+			if err := p.distGeometry(ctx, nkey, m); err != nil {
+				return 0, err
+			}
+
+			var rs *rangeSink
+			lo, hi, rs = distSpan(w, start, end, m.Size, m.ChunkSize)
+			if rs == nil { // empty, same as GETRANGE
+				return 0, w.Begin(0)
+			}
+
+			sink = rs
+		}
+
+		begun, err := p.distRead(ctx, nkey, m, lo, hi, sink)
+		if errors.Is(err, errChecksum) {
+			distChecksumErrs.Add(1)
+			if !begun && attempt < *flags.DistRetries {
+				glog.Warningf("[distGet] %v: %v, retry %v", nkey, err, attempt+1)
+				continue
+			}
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return hi - lo + 1, nil
+	}
+}
+
+// distGeometry sets the size and chunk size of m, if it has no checksums
+// (legacy 'nkey/len', or len=), from the sizes of its first and last chunks.
+// Under -compress prefixes, STRLEN is of the compressed chunks, so those are
+// read (and decompressed) instead.
+func (p *proxy) distGeometry(ctx context.Context, nkey string, m *distManifest) error {
+	if m.verified() {
+		return nil
+	}
+
+	var chunks map[int][]byte
+	if compressCodec(nkey) != "" {
+		var err error
+		chunks, err = p.cluster.GetChunks(ctx, nkey, m.Layout, []int{0, m.Chunks - 1})
+		if err != nil {
+			return fmt.Errorf("ERR %w", err)
+		}
+	}
+
+	strlen := func(i int) (int64, error) {
+		var n int64
+		switch {
+		case chunks != nil:
+			n = int64(len(chunks[i]))
+		default:
+			host := p.cluster.ChunkOwner(nkey, i, m.Layout)
+			key := cluster.ChunkKey(nkey, i)
+			r, err := p.cluster.DoMember(ctx, host, [][]byte{[]byte("STRLEN"), []byte(key)})
+			if err != nil {
+				return 0, fmt.Errorf("ERR %w", err)
+			}
+
+			n, _ = r.(int64)
+		}
+
+		if n == 0 && i < m.Chunks-1 {
+			return 0, fmt.Errorf("ERR index [%v] not found", i)
+		}
+
+		return n, nil
+	}
+
+	first, err := strlen(0)
+	if err != nil {
+		return err
+	}
+
+	last := first
+	if m.Chunks > 1 {
+		if last, err = strlen(m.Chunks - 1); err != nil {
+			return err
+		}
+	}
+
+	if first == 0 { // single, empty chunk
+		first = 1
+	}
+
+	m.ChunkSize = int(first)
+	m.Size = int64(m.Chunks-1)*first + last
+	return nil
+}
+
+// distSpan returns the chunks lo to hi that hold bytes start to end of a
+// value of size bytes, in chunkSize chunks, and the rangeSink that trims them
+// for w. Same as GETRANGE, negative offsets are from the end, and out of range
+// ones are clamped; the sink is nil if the range is empty.
+func distSpan(w distSink, start, end, size int64, chunkSize int) (int, int, *rangeSink) {
+	if start < 0 {
+		start += size
+	}
+
+	if end < 0 {
+		end += size
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if end >= size {
+		end = size - 1
+	}
+
+	if start > end {
+		return 0, 0, nil
+	}
+
+	lo, hi := int(start/int64(chunkSize)), int(end/int64(chunkSize))
+	return lo, hi, &rangeSink{w: w, skip: start - int64(lo)*int64(chunkSize), n: end - start + 1}
+}
+
+// rangeSink passes n bytes to w, after skipping the first skip bytes.
+type rangeSink struct {
+	w       distSink
+	skip, n int64
+}
+
+func (s *rangeSink) Begin(int64) error { return s.w.Begin(s.n) }
+
+func (s *rangeSink) Write(b []byte) (int, error) {
+	l := len(b)
+	if s.skip >= int64(l) {
+		s.skip -= int64(l)
+		return l, nil
+	}
+
+	b = b[s.skip:]
+	s.skip = 0
+	if int64(len(b)) > s.n {
+		b = b[:s.n]
+	}
+
+	s.n -= int64(len(b))
+	if len(b) == 0 {
+		return l, nil
+	}
+
+	if _, err := s.w.Write(b); err != nil {
+		return 0, err
+	}
+
+	return l, nil
+}
+
+// distRead reads chunks lo to hi (inclusive) in m for distGet. Returns true
+// if anything was written to w.
+func (p *proxy) distRead(ctx context.Context, nkey string, m *distManifest, lo, hi int, w distSink) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx) // stops our streams on return
+	defer cancel()
+	layout := m.Layout
+	dc := newDistChunks(m.Chunks)
+	dc.only(lo, hi)
+	self := p.app.FleetOp.Name()
+	nodes := p.app.FleetOp.Members()
+	p.prunePeers(nodes)
+	missing := dc.unsized()
+	for round := 0; round <= *flags.DistRetries && len(missing) > 0; round++ {
+		if len(nodes) == 0 {
+			nodes = []string{self}
+		}
+
+		if round > 0 {
+			distRetries.Add(1)
+			glog.Warningf("[distGet] %v: retry %v for %v chunks with %v", nkey, round, len(missing), nodes)
+			select {
+			case <-ctx.Done():
+				return false, cluster.ErrTimeout
+			case <-time.After(time.Duration(round) * 50 * time.Millisecond):
+			}
+		}
+
+		// Assign query indeces to all members.
+		assign := make(map[string][]int)
+		for i, id := range missing {
+			m := nodes[i%len(nodes)]
+			assign[m] = append(assign[m], id)
+		}
+
+		timeout := distPeerTimeout(ctx, *flags.DistRetries-round+1)
+		nodes = p.distFetch(ctx, nkey, layout, assign, dc, timeout)
+		n := len(missing)
+		missing = dc.unsized()
+		if round > 0 {
+			distRecovered.Add(int64(n - len(missing)))
+		}
+	}
+
+	if len(missing) > 0 {
+		// Last resort; whatever is still missing here is really not in Redis.
+		found, err := p.cluster.GetChunks(ctx, nkey, layout, missing)
+		src := dc.source()
+		for id, b := range found {
+			dc.setSize(id, src, int64(len(b)))
+			dc.add(id, src, 0, b)
+		}
+
+		distRecovered.Add(int64(len(found)))
+		missing = dc.unsized()
+		if err != nil && len(missing) > 0 {
+			return false, fmt.Errorf("ERR incomplete cache data: %w", err)
+		}
+	}
+
+	if len(missing) > 0 {
+		return false, fmt.Errorf("ERR index [%v] not found", missing[0])
+	}
+
+	if m.ChunkSize > 0 {
+		// Sizes are enough to catch most mixed versions before we start.
+		for i := lo; i <= hi; i++ {
+			if dc.sizeOf(i) != m.chunkLen(i) {
+				return false, fmt.Errorf("%w [%v]", errChecksum, i)
+			}
+		}
+	}
+
+	// Begin is delayed until the first chunk is verified, so we can still
+	// retry the whole read if it's not.
+	begun := false
+	for i := lo; i <= hi; i++ {
+		b, err := dc.wait(ctx, i)
+		if err != nil {
+			return begun, err
+		}
+
+		if b == nil {
+			// Its stream broke after the header; read it ourselves. It has to
+			// be the same size, as we may have already sent the total.
+			found, err := p.cluster.GetChunks(ctx, nkey, layout, []int{i})
+			v, ok := found[i]
+			if err != nil || !ok || int64(len(v)) != dc.sizeOf(i) {
+				return begun, fmt.Errorf("ERR chunk [%v] lost mid-stream", i)
+			}
+
+			distRecovered.Add(1)
+			b = v
+		}
+
+		if err := m.check(i, b); err != nil {
+			return begun, err
+		}
+
+		if !begun {
+			if err := w.Begin(dc.total()); err != nil {
+				return false, err
+			}
+
+			begun = true
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return begun, err
+		}
+
+		dc.release(i)
+	}
+
+	return begun, nil
+}
+
+// distPeerTimeout returns how long distStream waits for each message from a
+// peer, in a round with rounds left (this one included): -distpeertimeout,
+// but no more than an even share of what's left until ctx's deadline among
+// those and our last resort read, so silent peers still leave us time to
+// reassign their chunks.
+func distPeerTimeout(ctx context.Context, rounds int) time.Duration {
+	d := *flags.DistPeerTimeout
+	if dl, ok := ctx.Deadline(); ok {
+		if share := time.Until(dl) / time.Duration(rounds+1); share < d {
+			d = share
+		}
+	}
+
+	return d
+}
+
+// distFetch starts reading the chunks in assign (fleet member to chunk ids)
+// into dc, and returns once all headers are in (or their streams failed, or
+// timed out); data keeps arriving in the background. Returns the members
+// that replied.
+func (p *proxy) distFetch(ctx context.Context, nkey, layout string, assign map[string][]int,
+	dc *distChunks, timeout time.Duration) []string {
+	self := p.app.FleetOp.Name()
+	var w sync.WaitGroup
+	var mtx sync.Mutex
+	ok := []string{}
+	for member, ids := range assign {
+		w.Add(1)
+		var once sync.Once
+		header := func(member string) func(bool) {
+			return func(success bool) {
+				once.Do(func() {
+					if success {
+						mtx.Lock()
+						ok = append(ok, member)
+						mtx.Unlock()
+					}
+
+					w.Done()
+				})
+			}
+		}(member)
+
+		src := dc.source()
+		if member == self {
+			go func(ids []int) {
+				found, err := p.cluster.GetChunks(ctx, nkey, layout, ids)
+				if err != nil {
+					glog.Errorf("[distGet] %v: local read failed: %v", nkey, err)
+				}
+
+				for id, b := range found {
+					dc.setSize(id, src, int64(len(b)))
+					dc.add(id, src, 0, b)
+				}
+
+				header(true)
+			}(ids)
+
+			continue
+		}
+
+		go p.distStream(ctx, member, nkey, layout, ids, src, dc, timeout, header)
+	}
+
+	w.Wait()
+	sort.Strings(ok)
+	return ok
+}
+
+// distStream reads ids from member's DistributedGet rpc into dc. header is
+// called once, after the header arrives, or on failure before that. Data is
+// only read when there's room for it (see room), so the rest waits in member,
+// held back by gRPC's flow control. The stream is dropped if member is silent
+// for timeout while we wait for its header, or data; its chunks are then
+// reassigned, or read by us.
+func (p *proxy) distStream(ctx context.Context, member, nkey, layout string, ids []int,
+	src int, dc *distChunks, timeout time.Duration, header func(bool)) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(timeout, cancel)
+	defer idle.Stop()
+	defer func() {
+		header(false) // no-op if already called
+		for _, id := range ids {
+			dc.fail(id, src) // no-op if complete
+		}
+	}()
+
+	client, err := p.peer(member)
+	if err != nil {
+		glog.Errorf("[distGet] %v: peer %v: %v", nkey, member, err)
+		return
+	}
+
+	req := &v1.DistributedGetRequest{Name: nkey, Layout: layout}
+	for _, id := range ids {
+		req.Ids = append(req.Ids, int32(id))
+	}
+
+	var hdr *v1.DistributedGetResponse
+	stream, err := client.DistributedGet(ctx, req)
+	if err == nil {
+		hdr, err = stream.Recv()
+	}
+
+	switch {
+	case !idle.Stop():
+		glog.Errorf("[distGet] %v: no header from %v within %v", nkey, member, timeout)
+		return
+	case err != nil:
+		glog.Errorf("[distGet] %v: header from %v failed: %v", nkey, member, err)
+		return
+	}
+
+	for id, size := range hdr.Sizes {
+		dc.setSize(int(id), src, size)
+	}
+
+	header(true)
+	for {
+		if err := dc.room(ctx, src, ids); err != nil {
+			return
+		}
+
+		idle.Reset(timeout)
+		msg, err := stream.Recv()
+		switch {
+		case !idle.Stop():
+			glog.Errorf("[distGet] %v: no data from %v within %v", nkey, member, timeout)
+			return
+		case err == io.EOF:
+			return
+		case err != nil:
+			if ctx.Err() == nil {
+				glog.Errorf("[distGet] %v: data from %v failed: %v", nkey, member, err)
+			}
+
+			return
+		}
+
+		dc.add(int(msg.Id), src, msg.Offset, msg.Data)
+	}
+}
+
+// peerAddr returns the address of member's (a hedge id, fmt: ip:port) gRPC
+// API, which is assumed to listen on the same port as ours.
+func peerAddr(member string) (string, error) {
+	host, _, err := net.SplitHostPort(member)
+	if err != nil {
+		return "", err
+	}
+
+	_, port, err := net.SplitHostPort(*flags.GrpcAddr)
+	if err != nil {
+		return "", fmt.Errorf("no tcp port for peers in -grpcaddr: %w", err)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// peer returns a client for member's gRPC API.
+func (p *proxy) peer(member string) (v1.JupiterClient, error) {
+	addr, err := peerAddr(member)
+	if err != nil {
+		return nil, err
+	}
+
+	p.peerMtx.Lock()
+	defer p.peerMtx.Unlock()
+	if cc, ok := p.peers[addr]; ok {
+		return v1.NewJupiterClient(cc), nil
+	}
+
+	creds := insecure.NewCredentials()
+	if p.peerTLS != nil {
+		creds = credentials.NewTLS(p.peerTLS)
+	}
+
+	cc, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	p.peers[addr] = cc
+	return v1.NewJupiterClient(cc), nil
+}
+
+// prunePeers closes our connections to peers no longer in members.
+func (p *proxy) prunePeers(members []string) {
+	keep := make(map[string]bool)
+	for _, m := range members {
+		if addr, err := peerAddr(m); err == nil {
+			keep[addr] = true
+		}
+	}
+
+	p.peerMtx.Lock()
+	defer p.peerMtx.Unlock()
+	for addr, cc := range p.peers {
+		if !keep[addr] {
+			glog.Infof("[distGet] closing connection to %v, no longer in the fleet", addr)
+			cc.Close()
+			delete(p.peers, addr)
+		}
+	}
+}
+
+// distChunks tracks the chunks of one DISTGET as they arrive. Each chunk is
+// owned by the source (stream) that sent its size; data from other sources
+// is ignored.
+type distChunks struct {
+	mtx     sync.Mutex
+	sources int
+	owner   []int   // 0 = none
+	size    []int64 // -1 = unknown
+	data    [][]byte
+	done    []chan struct{} // closed when complete, or its source failed
+	closed  []bool
+	next    int           // next chunk to write
+	moved   chan struct{} // closed (and replaced) when next moves
+}
+
+func newDistChunks(n int) *distChunks {
+	dc := &distChunks{
+		owner:  make([]int, n),
+		size:   make([]int64, n),
+		data:   make([][]byte, n),
+		done:   make([]chan struct{}, n),
+		closed: make([]bool, n),
+		moved:  make(chan struct{}),
+	}
+
+	for i := 0; i < n; i++ {
+		dc.size[i] = -1
+		dc.done[i] = make(chan struct{})
+	}
+
+	return dc
+}
+
+// only skips all chunks but lo to hi (inclusive); they're empty, and have
+// no owner that could claim them.
+func (dc *distChunks) only(lo, hi int) {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	dc.next = lo
+	for i := range dc.size {
+		if i < lo || i > hi {
+			dc.owner[i] = -1
+			dc.size[i] = 0
+			dc.closed[i] = true
+			close(dc.done[i])
+		}
+	}
+}
+
+// source returns a new source id.
+func (dc *distChunks) source() int {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	dc.sources++
+	return dc.sources
+}
+
+func (dc *distChunks) setSize(id, src int, size int64) {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	if id < 0 || id >= len(dc.size) || dc.owner[id] != 0 {
+		return
+	}
+
+	dc.owner[id] = src
+	dc.size[id] = size
+	dc.data[id] = make([]byte, 0, size)
+	if size == 0 {
+		dc.closed[id] = true
+		close(dc.done[id])
+	}
+}
+
+func (dc *distChunks) add(id, src int, offset int64, b []byte) {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	if id < 0 || id >= len(dc.size) || dc.owner[id] != src || dc.closed[id] {
+		return
+	}
+
+	if offset != int64(len(dc.data[id])) || offset+int64(len(b)) > dc.size[id] {
+		dc.data[id] = nil // corrupt; wait() will report it as failed
+		dc.closed[id] = true
+		close(dc.done[id])
+		return
+	}
+
+	dc.data[id] = append(dc.data[id], b...)
+	if int64(len(dc.data[id])) == dc.size[id] {
+		dc.closed[id] = true
+		close(dc.done[id])
+	}
+}
+
+// fail marks id as failed, if src owns it, and it's not complete yet.
+func (dc *distChunks) fail(id, src int) {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	if id < 0 || id >= len(dc.size) || dc.owner[id] != src || dc.closed[id] {
+		return
+	}
+
+	dc.data[id] = nil
+	dc.closed[id] = true
+	close(dc.done[id])
+}
+
+// unsized returns the ids with no known size (no owner) yet.
+func (dc *distChunks) unsized() []int {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	ids := []int{}
+	for i, o := range dc.owner {
+		if o == 0 {
+			ids = append(ids, i)
+		}
+	}
+
+	return ids
+}
+
+func (dc *distChunks) sizeOf(id int) int64 {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	return dc.size[id]
+}
+
+func (dc *distChunks) total() int64 {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	var n int64
+	for _, v := range dc.size {
+		n += v
+	}
+
+	return n
+}
+
+// wait blocks until id is complete, and returns its data, which is nil if
+// its source failed (and not empty).
+func (dc *distChunks) wait(ctx context.Context, id int) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, cluster.ErrTimeout
+	case <-dc.done[id]:
+	}
+
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	b := dc.data[id]
+	if b == nil && dc.size[id] == 0 {
+		b = []byte{}
+	}
+
+	return b, nil
+}
+
+// release drops our reference to id's data, once written, and moves on to
+// the next chunk.
+func (dc *distChunks) release(id int) {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	dc.data[id] = nil
+	dc.next = id + 1
+	close(dc.moved)
+	dc.moved = make(chan struct{})
+}
+
+// room blocks until the next of ids that src is to send (the first it owns
+// that's not complete) is within -distwindow chunks of the next one to write,
+// so we don't hold more than that in memory when our client is slower than
+// the fleet.
+func (dc *distChunks) room(ctx context.Context, src int, ids []int) error {
+	window := *flags.DistWindow
+	if window < 1 {
+		window = 1
+	}
+
+	for {
+		dc.mtx.Lock()
+		pending := -1
+		for _, id := range ids {
+			if id >= 0 && id < len(dc.size) && dc.owner[id] == src && !dc.closed[id] {
+				pending = id
+				break
+			}
+		}
+
+		ok := pending < 0 || pending < dc.next+window
+		moved := dc.moved
+		dc.mtx.Unlock()
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-moved:
+		}
+	}
+}
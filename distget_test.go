@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/flags"
+)
+
+// bufSink is a distSink in memory.
+type bufSink struct {
+	size int64
+	bytes.Buffer
+}
+
+func (s *bufSink) Begin(size int64) error {
+	s.size = size
+	return nil
+}
+
+func TestDistSpan(t *testing.T) {
+	const value = "0123456789abcdefghijABCDEFGHIJxyz" // 33 bytes, in 10-byte chunks
+	for _, tc := range []struct {
+		start, end int64
+		lo, hi     int
+		want       string // nil sink if empty
+	}{
+		{0, -1, 0, 3, value},
+		{0, 0, 0, 0, "0"},
+		{0, 9, 0, 0, "0123456789"},
+		{9, 10, 0, 1, "9a"},
+		{10, 19, 1, 1, "abcdefghij"},
+		{5, 25, 0, 2, "56789abcdefghijABCDEF"},
+		{30, 32, 3, 3, "xyz"},
+		{30, 100, 3, 3, "xyz"}, // end clamped
+		{-3, -1, 3, 3, "xyz"},
+		{-13, -12, 2, 2, "AB"},
+		{-4, -3, 2, 3, "Jx"},
+		{-100, 2, 0, 0, "012"}, // start clamped
+		{-100, -100, 0, 0, ""},
+		{-1, 0, 0, 0, ""},
+		{5, 4, 0, 0, ""},
+		{33, 40, 0, 0, ""},
+	} {
+		w := &bufSink{}
+		lo, hi, rs := distSpan(w, tc.start, tc.end, int64(len(value)), 10)
+		if rs == nil {
+			if tc.want != "" {
+				t.Errorf("distSpan(%v, %v) is empty, want %q", tc.start, tc.end, tc.want)
+			}
+
+			continue
+		}
+
+		if lo != tc.lo || hi != tc.hi {
+			t.Errorf("distSpan(%v, %v) = chunks %v..%v, want %v..%v", tc.start, tc.end, lo, hi, tc.lo, tc.hi)
+		}
+
+		// Chunks as they'd come, in odd pieces.
+		rs.Begin(int64(len(value)))
+		in := value[lo*10 : min(len(value), (hi+1)*10)]
+		for len(in) > 0 {
+			n := min(len(in), 3)
+			if m, err := rs.Write([]byte(in[:n])); m != n || err != nil {
+				t.Fatalf("rangeSink.Write = %v, %v, want %v", m, err, n)
+			}
+
+			in = in[n:]
+		}
+
+		if w.size != int64(len(tc.want)) || w.String() != tc.want {
+			t.Errorf("distSpan(%v, %v) = %q (size %v), want %q", tc.start, tc.end, w.String(), w.size, tc.want)
+		}
+	}
+}
+
+func TestRangeSink(t *testing.T) {
+	for _, tc := range []struct {
+		skip, n int64
+		writes  []string
+		want    string
+	}{
+		{0, 3, []string{"abcdef"}, "abc"},
+		{2, 3, []string{"abcdef"}, "cde"},
+		{2, 3, []string{"a", "b", "cd", "efg"}, "cde"},
+		{4, 10, []string{"ab", "cd", "ef"}, "ef"}, // short input
+		{6, 1, []string{"abc", "def"}, ""},
+		{0, 0, []string{"abc"}, ""},
+		{1, 2, []string{"", "abc", ""}, "bc"},
+	} {
+		w := &bufSink{}
+		rs := &rangeSink{w: w, skip: tc.skip, n: tc.n}
+		rs.Begin(100)
+		for _, b := range tc.writes {
+			if n, err := rs.Write([]byte(b)); n != len(b) || err != nil {
+				t.Errorf("Write(%q) = %v, %v, want %v", b, n, err, len(b))
+			}
+		}
+
+		if w.size != tc.n || w.String() != tc.want {
+			t.Errorf("rangeSink{%v, %v} %q = %q (size %v), want %q (size %v)", tc.skip, tc.n, tc.writes, w.String(), w.size, tc.want, tc.n)
+		}
+	}
+}
+
+// dcOp is a call to distChunks, from a source.
+type dcOp struct {
+	op      string // size, add, fail
+	id, src int
+	n       int64 // size, or offset for add
+	data    string
+}
+
+func TestDistChunks(t *testing.T) {
+	const failed = "<failed>"
+	for _, tc := range []struct {
+		name    string
+		n       int      // chunks
+		lo, hi  int      // only these
+		ops     []dcOp   // sources are 1 and 2
+		unsized []int    // after ops
+		want    []string // wait() of lo..hi, if all sized
+	}{
+		{
+			name: "one source", n: 2, lo: 0, hi: 1,
+			ops: []dcOp{
+				{"size", 0, 1, 3, ""}, {"size", 1, 1, 2, ""},
+				{"add", 0, 1, 0, "ab"}, {"add", 0, 1, 2, "c"}, {"add", 1, 1, 0, "de"},
+			},
+			want: []string{"abc", "de"},
+		},
+		{
+			name: "first size wins", n: 1, lo: 0, hi: 0,
+			ops: []dcOp{
+				{"size", 0, 1, 3, ""}, {"size", 0, 2, 5, ""},
+				{"add", 0, 2, 0, "vwxyz"}, // not its owner
+				{"add", 0, 1, 0, "abc"},
+			},
+			want: []string{"abc"},
+		},
+		{
+			name: "unsized until claimed", n: 3, lo: 0, hi: 2,
+			ops:     []dcOp{{"size", 1, 1, 1, ""}, {"fail", 0, 1, 0, ""}},
+			unsized: []int{0, 2},
+		},
+		{
+			name: "reassigned", n: 2, lo: 0, hi: 1,
+			ops: []dcOp{
+				{"size", 0, 1, 1, ""}, {"add", 0, 1, 0, "a"},
+				{"fail", 1, 1, 0, ""}, // never sized; free for the next round
+				{"size", 1, 2, 1, ""}, {"add", 1, 2, 0, "b"},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "failed after size", n: 2, lo: 0, hi: 1,
+			ops: []dcOp{
+				{"size", 0, 1, 2, ""}, {"add", 0, 1, 0, "a"}, {"fail", 0, 1, 0, ""},
+				{"size", 1, 1, 1, ""}, {"add", 1, 1, 0, "b"}, {"fail", 1, 1, 0, ""}, // complete already
+				{"size", 0, 2, 2, ""}, {"add", 0, 2, 0, "xy"}, // can't take it over
+			},
+			want: []string{failed, "b"},
+		},
+		{
+			name: "fail from another source", n: 1, lo: 0, hi: 0,
+			ops:  []dcOp{{"size", 0, 1, 1, ""}, {"fail", 0, 2, 0, ""}, {"add", 0, 1, 0, "a"}},
+			want: []string{"a"},
+		},
+		{
+			name: "gap", n: 1, lo: 0, hi: 0,
+			ops:  []dcOp{{"size", 0, 1, 4, ""}, {"add", 0, 1, 0, "ab"}, {"add", 0, 1, 3, "d"}},
+			want: []string{failed},
+		},
+		{
+			name: "overrun", n: 1, lo: 0, hi: 0,
+			ops:  []dcOp{{"size", 0, 1, 2, ""}, {"add", 0, 1, 0, "abc"}},
+			want: []string{failed},
+		},
+		{
+			name: "empty chunk", n: 1, lo: 0, hi: 0,
+			ops:  []dcOp{{"size", 0, 1, 0, ""}, {"fail", 0, 1, 0, ""}},
+			want: []string{""},
+		},
+		{
+			name: "range", n: 5, lo: 1, hi: 2,
+			ops:     []dcOp{{"size", 0, 1, 9, ""}, {"size", 1, 1, 1, ""}, {"add", 1, 1, 0, "b"}}, // 0 is skipped
+			unsized: []int{2},
+		},
+		{
+			name: "out of bounds", n: 1, lo: 0, hi: 0,
+			ops:     []dcOp{{"size", 1, 1, 1, ""}, {"size", -1, 1, 1, ""}, {"add", 1, 1, 0, "a"}, {"fail", 5, 1, 0, ""}},
+			unsized: []int{0},
+		},
+	} {
+		dc := newDistChunks(tc.n)
+		dc.only(tc.lo, tc.hi)
+		dc.source()
+		dc.source()
+		for _, o := range tc.ops {
+			switch o.op {
+			case "size":
+				dc.setSize(o.id, o.src, o.n)
+			case "add":
+				dc.add(o.id, o.src, o.n, []byte(o.data))
+			case "fail":
+				dc.fail(o.id, o.src)
+			}
+		}
+
+		if got := dc.unsized(); !reflect.DeepEqual(got, append([]int{}, tc.unsized...)) {
+			t.Errorf("%v: unsized() = %v, want %v", tc.name, got, tc.unsized)
+		}
+
+		if len(tc.unsized) > 0 {
+			continue
+		}
+
+		var total int64
+		for i := 0; i < tc.n; i++ {
+			total += dc.sizeOf(i)
+		}
+
+		if dc.total() != total {
+			t.Errorf("%v: total() = %v, want %v", tc.name, dc.total(), total)
+		}
+
+		for i := tc.lo; i <= tc.hi; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			b, err := dc.wait(ctx, i)
+			cancel()
+			got := string(b)
+			if b == nil {
+				got = failed
+			}
+
+			if err != nil || got != tc.want[i-tc.lo] {
+				t.Errorf("%v: wait(%v) = %q, %v, want %q", tc.name, i, got, err, tc.want[i-tc.lo])
+			}
+		}
+	}
+}
+
+func TestDistChunksRoom(t *testing.T) {
+	old := *flags.DistWindow
+	t.Cleanup(func() { *flags.DistWindow = old })
+	*flags.DistWindow = 2
+	dc := newDistChunks(4)
+	dc.only(0, 3)
+	src := dc.source()
+	for i := 0; i < 4; i++ {
+		dc.setSize(i, src, 1)
+	}
+
+	room := func(ids ...int) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		return dc.room(ctx, src, ids) == nil
+	}
+
+	for _, tc := range []struct {
+		release int // before, -1 = none
+		ids     []int
+		want    bool
+	}{
+		{-1, []int{0, 1, 2, 3}, true},
+		{-1, []int{2, 3}, false}, // next is 0
+		{-1, []int{1}, true},
+		{0, []int{2, 3}, true},
+		{0, []int{3}, false},
+		{1, []int{3}, true},
+		{-1, []int{9}, true}, // nothing pending
+	} {
+		if tc.release >= 0 {
+			dc.add(tc.release, src, 0, []byte("x"))
+			dc.release(tc.release)
+		}
+
+		if got := room(tc.ids...); got != tc.want {
+			t.Errorf("room(%v) after release(%v) = %v, want %v", tc.ids, tc.release, got, tc.want)
+		}
+	}
+
+	// Waiters move on as soon as the next chunk does.
+	dc = newDistChunks(4)
+	src = dc.source()
+	dc.setSize(3, src, 1)
+	done := make(chan error)
+	go func() { done <- dc.room(context.Background(), src, []int{3}) }()
+	dc.release(0)
+	select {
+	case <-done:
+		t.Errorf("room() returned with 3 pending, and next at 1")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	dc.release(1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("room() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("room() still blocked")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"github.com/golang/glog"
+	goredisv9 "github.com/redis/go-redis/v9"
+)
+
+const (
+	gatewayMaxBody  = 512 << 20 // Redis' limit for strings
+	gatewayParallel = 64        // most keys of a batch in flight at a time
+)
+
+var (
+	httpReqs = metrics.Counter("http_requests")
+	httpErrs = metrics.Counter("http_errors")
+
+	errNotFound = errors.New("key not found")
+)
+
+// badRequest is an error in the request itself; it's sent as 400.
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+// gateway is our HTTP/JSON API for clients that can't hold Redis connections
+// (i.e. serverless functions, scripts). Routes:
+//
+//	GET    /v1/keys/{key}      - value as body (application/octet-stream), 404 if none
+//	PUT    /v1/keys/{key}      - body as value; optional ?ttl=
+//	DELETE /v1/keys/{key}      - 204 if deleted, 404 if none
+//	POST   /v1/batch/get       - {"keys":[...]}, replies {"items":[{"key","value"}]}
+//	POST   /v1/batch/set       - {"items":[{"key","value","ttl"}]}
+//	POST   /v1/batch/delete    - {"keys":[...]}, replies {"deleted":n}
+//	GET    /v1/distget/{key}   - DISTGET, streamed as body; optional ?len=, ?layout=,
+//	                             and ?start=, ?end= for DISTGETRANGE
+//
+// All routes accept ?hash= (same as the hash= directive) and ?timeout=. JSON
+// values are []byte, so they're base64-encoded. Timeouts are in the same
+// format as the timeout= directive (i.e. 500ms, 2s, or milliseconds); TTLs
+// are durations too, but bare integers are seconds, same as EXPIRE.
+type gateway struct {
+	p *proxy
+}
+
+func newGateway(p *proxy) *gateway { return &gateway{p: p} }
+
+type gatewayItem struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	TTL   string `json:"ttl,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type gatewayBatch struct {
+	Keys  []string      `json:"keys,omitempty"`
+	Items []gatewayItem `json:"items,omitempty"`
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpReqs.Add(1)
+	q := r.URL.Query()
+	var timeout time.Duration
+	if v := q.Get("timeout"); v != "" {
+		t, err := parseTimeout(v)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout '%s'", v))
+			return
+		}
+
+		timeout = t
+	}
+
+	ctx, cancel := cluster.WithTimeout(cluster.WithClient(r.Context(), r.RemoteAddr), timeout)
+	defer cancel()
+
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/v1/keys/") && len(path) > len("/v1/keys/"):
+		g.key(ctx, w, r, strings.TrimPrefix(path, "/v1/keys/"))
+	case strings.HasPrefix(path, "/v1/batch/") && r.Method == http.MethodPost:
+		g.batch(ctx, w, r, strings.TrimPrefix(path, "/v1/batch/"))
+	case strings.HasPrefix(path, "/v1/distget/") && r.Method == http.MethodGet:
+		g.distGet(ctx, w, r, strings.TrimPrefix(path, "/v1/distget/"))
+	default:
+		g.writeError(w, http.StatusNotFound, fmt.Errorf("unknown route %v %v", r.Method, path))
+	}
+}
+
+// key handles the single-key routes.
+func (g *gateway) key(ctx context.Context, w http.ResponseWriter, r *http.Request, key string) {
+	hash := r.URL.Query().Get("hash")
+	switch r.Method {
+	case http.MethodGet:
+		v, err := g.get(ctx, key, hash)
+		if err != nil {
+			g.writeError(w, 0, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(v)
+	case http.MethodPut:
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, gatewayMaxBody))
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := g.set(ctx, key, hash, b, r.URL.Query().Get("ttl")); err != nil {
+			g.writeError(w, 0, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		n, err := g.del(ctx, key, hash)
+		if err != nil {
+			g.writeError(w, 0, err)
+			return
+		}
+
+		if n == 0 {
+			g.writeError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		g.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	}
+}
+
+// batch handles the multi-key routes. Keys are sent in parallel (up to
+// gatewayParallel at a time), each to its own member (or all to the owner of
+// ?hash=, if set). Per-key errors are returned in the items, not as the
+// response status.
+func (g *gateway) batch(ctx context.Context, w http.ResponseWriter, r *http.Request, op string) {
+	var in gatewayBatch
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, gatewayMaxBody)).Decode(&in)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hash := r.URL.Query().Get("hash")
+	var out interface{}
+	switch op {
+	case "get":
+		items := make([]gatewayItem, len(in.Keys))
+		g.parallel(len(items), func(i int) {
+			items[i].Key = in.Keys[i]
+			v, err := g.get(ctx, in.Keys[i], hash)
+			switch {
+			case errors.Is(err, errNotFound): // leave as null
+			case err != nil:
+				items[i].Error = err.Error()
+			default:
+				items[i].Value = v
+			}
+		})
+
+		out = gatewayBatch{Items: items}
+	case "set":
+		items := make([]gatewayItem, len(in.Items))
+		g.parallel(len(items), func(i int) {
+			it := in.Items[i]
+			items[i].Key = it.Key
+			if err := g.set(ctx, it.Key, hash, it.Value, it.TTL); err != nil {
+				items[i].Error = err.Error()
+			}
+		})
+
+		out = gatewayBatch{Items: items}
+	case "delete":
+		var mtx sync.Mutex
+		var deleted int64
+		var errs []string
+		g.parallel(len(in.Keys), func(i int) {
+			n, err := g.del(ctx, in.Keys[i], hash)
+			mtx.Lock()
+			defer mtx.Unlock()
+			deleted += n
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", in.Keys[i], err))
+			}
+		})
+
+		out = struct {
+			Deleted int64    `json:"deleted"`
+			Errors  []string `json:"errors,omitempty"`
+		}{deleted, errs}
+	default:
+		g.writeError(w, http.StatusNotFound, fmt.Errorf("unknown batch op '%v'", op))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// distGet streams DISTGET's (or DISTGETRANGE's) output as the response body.
+func (g *gateway) distGet(ctx context.Context, w http.ResponseWriter, r *http.Request, key string) {
+	var chunks int
+	if v := r.URL.Query().Get("len"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid len '%s'", v))
+			return
+		}
+
+		chunks = n
+	}
+
+	layout := r.URL.Query().Get("layout")
+	if layout != "" && layout != cluster.LayoutHashed && layout != cluster.LayoutSpread {
+		g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid layout '%s'", layout))
+		return
+	}
+
+	rng := []int64{0, -1}
+	for i, name := range []string{"start", "end"} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %v '%s'", name, v))
+				return
+			}
+
+			rng[i] = n
+		}
+	}
+
+	sw := &gatewayStream{w: w}
+	_, err := g.p.distGetRange(ctx, key, chunks, layout, rng[0], rng[1], sw)
+	if err != nil && !sw.started {
+		g.writeError(w, 0, err)
+		return
+	}
+
+	if err != nil {
+		glog.Errorf("[gateway] distget %v failed mid-stream: %v", key, err)
+	}
+}
+
+// gatewayStream sets the headers on Begin, then flushes each chunk to the
+// client as it's written.
+type gatewayStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *gatewayStream) Begin(size int64) error {
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/octet-stream")
+	s.w.Header().Set("Content-Length", fmt.Sprint(size))
+	return nil
+}
+
+func (s *gatewayStream) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return n, err
+}
+
+func (g *gateway) get(ctx context.Context, key, hash string) ([]byte, error) {
+	hash = gatewayHash(key, hash)
+	v, err := g.p.nearGet(g.p.cluster.Locate(hash), key, func() (interface{}, error) {
+		return g.p.cluster.Do(ctx, hash, [][]byte{[]byte("GET"), []byte(key)})
+	})
+
+	switch {
+	case errors.Is(err, goredisv9.Nil):
+		return nil, errNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	if v, err = g.p.autoChunkValue(ctx, key, v); err != nil {
+		return nil, err
+	}
+
+	s, _ := decompressReply("GET", v).(string)
+	return []byte(s), nil
+}
+
+func (g *gateway) set(ctx context.Context, key, hash string, value []byte, ttl string) error {
+	if key == "" {
+		return badRequest("empty key")
+	}
+
+	hash = gatewayHash(key, hash)
+	defer g.p.nearWrote(g.p.cluster.Locate(hash), key)
+	var t time.Duration
+	args := [][]byte{[]byte("SET"), []byte(key), value}
+	if ttl != "" {
+		var err error
+		t, err = parseTTL(ttl)
+		if err != nil || t < time.Millisecond { // PX's unit
+			return badRequest(fmt.Sprintf("invalid ttl '%s'", ttl))
+		}
+
+		args = append(args, []byte("PX"), []byte(fmt.Sprint(t.Milliseconds())))
+	}
+
+	if autoChunked(len(value)) {
+		return g.p.autoChunkPut(ctx, key, hash, value, t, "")
+	}
+
+	_, err := g.p.autoChunkDo(ctx, hash, compressArgs(args))
+	return err
+}
+
+func (g *gateway) del(ctx context.Context, key, hash string) (int64, error) {
+	hash = gatewayHash(key, hash)
+	defer g.p.nearWrote(g.p.cluster.Locate(hash), key)
+	v, err := g.p.autoChunkDo(ctx, hash, [][]byte{[]byte("DEL"), []byte(key)})
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := v.(int64)
+	return n, nil
+}
+
+// parallel calls fn(0..n-1), at most gatewayParallel at a time, and waits
+// for all of them. Batches are from one client, so this also keeps them well
+// under -clientqueue; the runners pipeline them anyway.
+func (g *gateway) parallel(n int, fn func(int)) {
+	var w sync.WaitGroup
+	sem := make(chan struct{}, gatewayParallel)
+	for i := 0; i < n; i++ {
+		w.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				w.Done()
+			}()
+
+			fn(i)
+		}(i)
+	}
+
+	w.Wait()
+}
+
+// parseTTL parses v as a TTL: same as parseTimeout, except that integers
+// are seconds.
+func parseTTL(v string) (time.Duration, error) {
+	if _, err := strconv.Atoi(v); err == nil {
+		v += "s"
+	}
+
+	return parseTimeout(v)
+}
+
+// writeError writes err as {"error": "..."}. If status is zero, it's derived
+// from err: errors from Redis itself are the client's (409 for WRONGTYPE, 400
+// for ERR), while anything else that failed in a member is a 502.
+func (g *gateway) writeError(w http.ResponseWriter, status int, err error) {
+	httpErrs.Add(1)
+	if status == 0 {
+		var bad badRequest
+		var rerr goredisv9.Error
+		switch {
+		case errors.As(err, &bad):
+			status = http.StatusBadRequest
+		case errors.As(err, &rerr) && strings.HasPrefix(rerr.Error(), "WRONGTYPE"):
+			status = http.StatusConflict
+		case errors.As(err, &rerr) && strings.HasPrefix(rerr.Error(), "ERR "):
+			status = http.StatusBadRequest
+		case errors.Is(err, errNotFound), errors.Is(err, errNoChunks):
+			status = http.StatusNotFound
+		case errors.Is(err, cluster.ErrTimeout):
+			status = http.StatusGatewayTimeout
+		case errors.Is(err, cluster.ErrBusy):
+			status = http.StatusServiceUnavailable
+		default:
+			status = http.StatusBadGateway
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// gatewayHash returns the hash key to use for key.
+func gatewayHash(key, hash string) string {
+	if hash != "" {
+		return hash
+	}
+
+	return key
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+)
+
+// ErrBusy is returned when a member can't take more commands: its queue
+// stayed full for -enqueuetimeout, or the client already has -clientqueue
+// commands in flight for it. Safe to retry later.
+var ErrBusy = errors.New("BUSY member overloaded, try again later")
+
+var (
+	busyRejections   = metrics.Counter("busy_rejections")
+	clientRejections = metrics.Counter("client_rejections")
+
+	enqueueTimeout atomic.Int64 // -enqueuetimeout, as set by SetEnqueueTimeout
+	unnamed        atomic.Int64 // ids for clients without an address
+)
+
+// SetEnqueueTimeout sets how long commands wait for room in a full member
+// queue (-enqueuetimeout); 0 = not at all. Can be called at runtime.
+func SetEnqueueTimeout(d time.Duration) { enqueueTimeout.Store(int64(d)) }
+
+// EnqueueTimeout returns how long commands wait for room in a full queue.
+func EnqueueTimeout() time.Duration { return time.Duration(enqueueTimeout.Load()) }
+
+type clientKey struct{}
+
+// WithClient returns a child of ctx for commands from the client at addr, for
+// the per-client limits of -clientqueue. Clients are connections (host:port),
+// so hosts behind the same NAT or load balancer don't share a limit. Unix
+// socket peers have no address; each call gets its own id for them.
+func WithClient(ctx context.Context, addr string) context.Context {
+	if addr == "" || addr == "@" {
+		addr = fmt.Sprintf("unix#%v", unnamed.Add(1))
+	}
+
+	return context.WithValue(ctx, clientKey{}, addr)
+}
+
+// clientOf returns the client id in ctx, if any.
+func clientOf(ctx context.Context) string {
+	s, _ := ctx.Value(clientKey{}).(string)
+	return s
+}
+
+// admit pushes c to mb's queue, waiting up to -enqueuetimeout for room, or
+// fails with ErrBusy. Clients over -clientqueue fail right away, so a single
+// client can't fill the queue for everyone else.
+func (mb *member) admit(ctx context.Context, c *rcmd) error {
+	if !mb.acquire(c) {
+		clientRejections.Add(1)
+		return fmt.Errorf("%w (%v, client %v)", ErrBusy, mb.host, c.client)
+	}
+
+	select {
+	case mb.queue <- c:
+		mb.queued()
+		return nil
+	case <-ctx.Done():
+		mb.release(c)
+		return ctx.Err()
+	default:
+	}
+
+	// Full; this is where we used to block indefinitely.
+	wait := EnqueueTimeout()
+	if wait <= 0 {
+		return mb.busy(c)
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case mb.queue <- c:
+		mb.queued()
+		return nil
+	case <-ctx.Done():
+		mb.release(c)
+		return ctx.Err()
+	case <-t.C:
+		return mb.busy(c)
+	}
+}
+
+func (mb *member) busy(c *rcmd) error {
+	mb.release(c)
+	busyRejections.Add(1)
+	return fmt.Errorf("%w (%v)", ErrBusy, mb.host)
+}
+
+// acquire counts c against its client's -clientqueue limit for mb. Returns
+// false if the client is at the limit already.
+func (mb *member) acquire(c *rcmd) bool {
+	if c.client == "" || *flags.ClientQueue <= 0 {
+		return true
+	}
+
+	mb.cmtx.Lock()
+	defer mb.cmtx.Unlock()
+	if mb.clients[c.client] >= *flags.ClientQueue {
+		return false
+	}
+
+	mb.clients[c.client]++
+	c.counted = true
+	return true
+}
+
+// release undoes acquire, once c is done (or was never queued).
+func (mb *member) release(c *rcmd) {
+	if !c.counted {
+		return
+	}
+
+	mb.cmtx.Lock()
+	defer mb.cmtx.Unlock()
+	if mb.clients[c.client]--; mb.clients[c.client] <= 0 {
+		delete(mb.clients, c.client)
+	}
+}
@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/flags"
+)
+
+// testMember returns a member with a queue of n, and no runners to take
+// from it.
+func testMember(t *testing.T, n, clientQueue int) *member {
+	t.Helper()
+	active, cq, wait := *flags.MaxActive, *flags.ClientQueue, EnqueueTimeout()
+	t.Cleanup(func() {
+		*flags.MaxActive, *flags.ClientQueue = active, cq
+		SetEnqueueTimeout(wait)
+	})
+
+	*flags.MaxActive, *flags.ClientQueue = 0, clientQueue
+	SetEnqueueTimeout(0)
+	return &member{
+		host:    "test:6379",
+		queue:   make(chan *rcmd, n),
+		stop:    make(chan struct{}),
+		clients: make(map[string]int),
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	type op struct {
+		client  string
+		release bool // the oldest acquired command of client
+		want    bool // for acquire
+	}
+
+	for _, tc := range []struct {
+		name  string
+		limit int
+		ops   []op
+		want  map[string]int // after ops
+	}{
+		{
+			name:  "up to the limit",
+			limit: 2,
+			ops:   []op{{"a", false, true}, {"a", false, true}, {"a", false, false}, {"b", false, true}},
+			want:  map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name:  "room after release",
+			limit: 1,
+			ops:   []op{{"a", false, true}, {"a", false, false}, {"a", true, false}, {"a", false, true}},
+			want:  map[string]int{"a": 1},
+		},
+		{
+			name:  "released to zero",
+			limit: 2,
+			ops:   []op{{"a", false, true}, {"b", false, true}, {"a", true, false}, {"b", true, false}},
+			want:  map[string]int{},
+		},
+		{
+			name:  "rejected ones aren't released",
+			limit: 1,
+			ops:   []op{{"a", false, true}, {"a", false, false}, {"a", true, false}, {"a", true, false}},
+			want:  map[string]int{},
+		},
+		{
+			name:  "no limit",
+			limit: 0,
+			ops:   []op{{"a", false, true}, {"a", false, true}, {"a", true, false}},
+			want:  map[string]int{},
+		},
+		{
+			name:  "no client",
+			limit: 1,
+			ops:   []op{{"", false, true}, {"", false, true}},
+			want:  map[string]int{},
+		},
+	} {
+		mb := testMember(t, 1, tc.limit)
+		var cmds []*rcmd
+		for i, o := range tc.ops {
+			if o.release {
+				for j, c := range cmds {
+					if c.client == o.client {
+						mb.release(c)
+						cmds = append(cmds[:j], cmds[j+1:]...)
+						break
+					}
+				}
+
+				continue
+			}
+
+			c := &rcmd{client: o.client}
+			if got := mb.acquire(c); got != o.want {
+				t.Errorf("%v: [%v] acquire(%q) = %v, want %v", tc.name, i, o.client, got, o.want)
+			}
+
+			cmds = append(cmds, c)
+		}
+
+		if len(mb.clients) != len(tc.want) {
+			t.Errorf("%v: clients = %v, want %v", tc.name, mb.clients, tc.want)
+			continue
+		}
+
+		for k, v := range tc.want {
+			if mb.clients[k] != v {
+				t.Errorf("%v: clients = %v, want %v", tc.name, mb.clients, tc.want)
+			}
+		}
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		queue   int
+		limit   int
+		wait    time.Duration // -enqueuetimeout
+		clients []string      // one command each, in order
+		cancel  bool          // ctx is done before the last one
+		want    []string      // per command: "" (queued), "client" or "busy", "canceled"
+	}{
+		{
+			name: "room", queue: 3, limit: 10,
+			clients: []string{"a", "a", "b"},
+			want:    []string{"", "", ""},
+		},
+		{
+			name: "full", queue: 2, limit: 10,
+			clients: []string{"a", "b", "c"},
+			want:    []string{"", "", "busy"},
+		},
+		{
+			name: "full, waited", queue: 1, limit: 10, wait: 10 * time.Millisecond,
+			clients: []string{"a", "b"},
+			want:    []string{"", "busy"},
+		},
+		{
+			name: "client over its limit", queue: 10, limit: 2,
+			clients: []string{"a", "a", "a", "b"},
+			want:    []string{"", "", "client", ""},
+		},
+		{
+			name: "canceled while waiting", queue: 1, limit: 10, wait: time.Minute, cancel: true,
+			clients: []string{"a", "b"},
+			want:    []string{"", "canceled"},
+		},
+	} {
+		mb := testMember(t, tc.queue, tc.limit)
+		SetEnqueueTimeout(tc.wait)
+		clientBefore, busyBefore := clientRejections.Load(), busyRejections.Load()
+		var clients, busy int64
+		for i, client := range tc.clients {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tc.cancel && i == len(tc.clients)-1 {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+
+			err := mb.admit(ctx, &rcmd{client: client})
+			cancel()
+			var got string
+			switch {
+			case err == nil:
+			case errors.Is(err, context.Canceled):
+				got = "canceled"
+			case errors.Is(err, ErrBusy) && strings.Contains(err.Error(), "client"):
+				got, clients = "client", clients+1
+			case errors.Is(err, ErrBusy):
+				got, busy = "busy", busy+1
+			default:
+				got = err.Error()
+			}
+
+			if got != tc.want[i] {
+				t.Errorf("%v: [%v] admit = %v, want %q", tc.name, i, err, tc.want[i])
+			}
+		}
+
+		// Only what's queued still counts against its client.
+		var n int
+		for _, v := range mb.clients {
+			n += v
+		}
+
+		if n != len(mb.queue) || mb.inflight.Load() != int64(len(mb.queue)) {
+			t.Errorf("%v: %v counted, %v in flight, want %v (queued)", tc.name, n, mb.inflight.Load(), len(mb.queue))
+		}
+
+		if d := clientRejections.Load() - clientBefore; d != clients {
+			t.Errorf("%v: client_rejections += %v, want %v", tc.name, d, clients)
+		}
+
+		if d := busyRejections.Load() - busyBefore; d != busy {
+			t.Errorf("%v: busy_rejections += %v, want %v", tc.name, d, busy)
+		}
+	}
+}
+
+func TestWithClient(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		same bool
+	}{
+		{"10.0.0.1:1234", "10.0.0.1:1234", true},
+		{"10.0.0.1:1234", "10.0.0.1:1235", false}, // connections, not hosts
+		{"[::1]:1234", "[::1]:1234", true},
+		{"", "", false}, // Unix socket peers
+		{"@", "@", false},
+	} {
+		a := clientOf(WithClient(context.Background(), tc.a))
+		b := clientOf(WithClient(context.Background(), tc.b))
+		if (a == b) != tc.same || a == "" {
+			t.Errorf("WithClient(%q), WithClient(%q) = %q, %q, want same: %v", tc.a, tc.b, a, b, tc.same)
+		}
+	}
+
+	if c := clientOf(context.Background()); c != "" {
+		t.Errorf("clientOf(no client) = %q, want none", c)
+	}
+}
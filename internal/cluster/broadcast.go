@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -19,10 +20,12 @@ const (
 type DistributedGetInput struct {
 	Name   string         `json:"name"`
 	Assign map[int]string `json:"assign"`
+	Layout string         `json:"layout,omitempty"` // LayoutHashed if empty
 }
 
 type DistributedGetOutput struct {
-	Data map[int][]byte `json:"data"`
+	Data    map[int][]byte `json:"data"`
+	Missing []int          `json:"missing,omitempty"` // assigned, but not read
 }
 
 var (
@@ -30,10 +33,14 @@ var (
 
 	CtrlBroadcastLeaderLiveness = "CTRL_BROADCAST_LEADER_LIVENESS"
 	CtrlBroadcastDistributedGet = "CTRL_BROADCAST_DISTRIBUTED_GET"
+	CtrlBroadcastScriptCache    = "CTRL_BROADCAST_SCRIPT_CACHE"
+	CtrlBroadcastNearCache      = "CTRL_BROADCAST_NEAR_CACHE"
 
 	fnBroadcast = map[string]func(*ClusterData, *cloudevents.Event) ([]byte, error){
 		CtrlBroadcastLeaderLiveness: doBroadcastLeaderLiveness,
 		CtrlBroadcastDistributedGet: doDistributedGet,
+		CtrlBroadcastScriptCache:    doScriptCache,
+		CtrlBroadcastNearCache:      doNearCache,
 	}
 
 	stringToBytes = func(s string) []byte {
@@ -71,6 +78,8 @@ func doBroadcastLeaderLiveness(cd *ClusterData, e *cloudevents.Event) ([]byte, e
 	return nil, nil
 }
 
+// doDistributedGet serves DISTGET chunk reads for proxies that predate the
+// DistributedGet rpc; only needed while rolling out mixed versions.
 func doDistributedGet(cd *ClusterData, e *cloudevents.Event) ([]byte, error) {
 	var line string
 	defer func(begin time.Time, m *string) {
@@ -88,45 +97,34 @@ func doDistributedGet(cd *ClusterData, e *cloudevents.Event) ([]byte, error) {
 
 	ids := []string{}
 	mgetIds := []int{}
-	mgets := [][]byte{[]byte("MGET")}
 	mb := make(map[int][]byte)
 	for k, v := range in.Assign {
 		if v == cd.App.FleetOp.Name() {
 			mgetIds = append(mgetIds, k)
-			mgets = append(mgets, []byte(fmt.Sprintf("%v/%v", in.Name, k)))
+			ids = append(ids, fmt.Sprintf("%v", k))
 		}
 	}
 
+	var missing []int
 	if len(mgetIds) > 0 {
-		v, err := cd.Cluster.Do(in.Name, mgets)
+		// One MGET per owner; for LayoutHashed, that's just the owner of Name.
+		// Partial results are fine; the caller retries what's missing.
+		ctx, cancel := WithTimeout(context.Background(), 0)
+		mb, err = cd.Cluster.GetChunks(ctx, in.Name, in.Layout, mgetIds)
+		cancel()
 		if err != nil {
-			return nil, err
+			glog.Errorf("[doDistributedGet] %v:[%v] failed: %v", in.Name, strings.Join(ids, ","), err)
 		}
 
 		for _, id := range mgetIds {
-			ids = append(ids, fmt.Sprintf("%v", id))
-		}
-
-		switch v.(type) {
-		case []interface{}:
-			for i, d := range v.([]interface{}) {
-				if _, ok := d.(string); !ok {
-					e := fmt.Errorf("unexpected non-string type for %v/%v, type=%T", in.Name, mgetIds[i], d)
-					glog.Error(e)
-					return nil, e
-				} else {
-					mb[mgetIds[i]] = stringToBytes(d.(string))
-				}
+			if _, ok := mb[id]; !ok {
+				missing = append(missing, id)
 			}
-		default:
-			e := fmt.Errorf("unknown type for [%v:%v]: %T", in.Name, strings.Join(ids, ","), v)
-			glog.Error(e)
-			return nil, e
 		}
 	}
 
-	line = fmt.Sprintf("%v:assigned=%v:[%v]", in.Name, len(ids), strings.Join(ids, ","))
-	out := DistributedGetOutput{Data: mb}
+	line = fmt.Sprintf("%v:assigned=%v:[%v], missing=%v", in.Name, len(ids), strings.Join(ids, ","), len(missing))
+	out := DistributedGetOutput{Data: mb, Missing: missing}
 	b, _ := json.Marshal(out)
 	return b, nil
 }
@@ -2,70 +2,112 @@ package cluster
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
 	"github.com/buraksezer/consistent"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
 	goredisv9 "github.com/redis/go-redis/v9"
 )
 
+var (
+	// ErrTimeout is returned when a command's deadline expires before a reply.
+	ErrTimeout = errors.New("TIMEOUT command deadline exceeded")
+
+	// ErrClosed is returned for commands still queued when a member is closed.
+	ErrClosed = errors.New("ERR member closed")
+
+	timeouts = metrics.Counter("command_timeouts")
+	dropped  = metrics.Counter("dropped_commands")
+
+	cmdTimeout atomic.Int64 // -cmdtimeout, as set by SetCmdTimeout
+)
+
 type cmember string
 
 func (m cmember) String() string { return string(m) }
 
 type rcmd struct {
+	ctx    context.Context
 	cmd    string
 	args   []interface{}
 	runner string
 	done   chan error
 	reply  interface{}
+
+	client  string // see WithClient
+	counted bool   // against client's -clientqueue
 }
 
 func (rc *rcmd) String() string { return fmt.Sprintf("%v %v", rc.cmd, rc.args) }
 
 type member struct {
-	host   string // fmt: host:port
-	client *goredisv9.Client
-	queue  chan *rcmd
-	done   sync.WaitGroup
+	host    string // fmt: host:port
+	client  *goredisv9.Client
+	queue   chan *rcmd
+	stop    chan struct{} // closed on Close; never the queue, see admit
+	done    sync.WaitGroup
+	replica *member // optional, for read-only commands
+
+	// See pool.go.
+	runners  atomic.Int32
+	free     atomic.Int32  // runners waiting for commands
+	blocked  atomic.Int32  // runners in a blocking command
+	inflight atomic.Int64  // queued or running
+	load     atomic.Uint64 // float64 bits; moving average of inflight
+	seq      atomic.Int64  // for runner ids
+
+	// See admit.go.
+	cmtx    sync.Mutex
+	clients map[string]int // commands in flight per client
 }
 
 type Cluster struct {
 	mtx        sync.RWMutex
 	members    map[string]*member
 	consistent *consistent.Consistent
+
+	Scripts *ScriptCache // scripts/functions loaded through the proxy
+	Near    *NearCache   // values of -nearcache keys read through the proxy
+}
+
+// newMember creates the client and runners for host. The pool has room for
+// one connection per runner, so runners never wait for one.
+func (m *Cluster) newMember(host string) *member {
+	mb := &member{
+		host: host,
+		client: goredisv9.NewClient(&goredisv9.Options{
+			Addr:                  host,
+			MaxRetries:            -1, // don't retry
+			PoolSize:              *flags.MaxActive,
+			MinIdleConns:          *flags.MinRunners,
+			PoolTimeout:           *flags.PoolTimeout,
+			ReadTimeout:           *flags.ReadTimeout,
+			WriteTimeout:          *flags.WriteTimeout,
+			ContextTimeoutEnabled: true, // honor our per-command deadlines
+		}),
+		queue:   make(chan *rcmd, *flags.QueueSize),
+		stop:    make(chan struct{}),
+		clients: make(map[string]int),
+	}
+
+	mb.start()
+	return mb
 }
 
 func (m *Cluster) AddMember(host string) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	if _, found := m.members[host]; !found {
-		m.members[host] = &member{
-			host: host,
-			client: goredisv9.NewClient(&goredisv9.Options{
-				Addr:         host,
-				MaxRetries:   -1, // don't retry
-				PoolTimeout:  time.Minute * 3,
-				ReadTimeout:  time.Minute * 2,
-				WriteTimeout: time.Minute * 2,
-			}),
-			queue: make(chan *rcmd, 10_000),
-		}
-
-		for i := 0; i < *flags.MaxActive; i++ {
-			id := fmt.Sprintf("%v/%04d", host, i)
-			m.members[host].done.Add(1)
-			go m.runner(
-				id,
-				m.members[host].client,
-				m.members[host].queue,
-				&m.members[host].done,
-			)
-		}
+		m.members[host] = m.newMember(host)
 	}
 
 	if m.consistent == nil {
@@ -85,22 +127,88 @@ func (m *Cluster) AddMember(host string) {
 	}
 }
 
-func (m *Cluster) runner(id string, client *goredisv9.Client, queue chan *rcmd, done *sync.WaitGroup) {
-	defer func() { done.Done() }()
-	glog.Infof("runner %v started", id)
-	for j := range queue {
-		j.runner = id
-		args := []interface{}{j.cmd}
-		args = append(args, j.args...)
-		out, err := client.Do(context.Background(), args...).Result()
-		j.reply = out
-		j.done <- err
+// ctxErr converts context errors to what we return to callers.
+func ctxErr(err error) error {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return ErrTimeout
+	default:
+		return err
 	}
 }
 
-func (m *Cluster) Do(key string, args [][]byte) (interface{}, error) {
-	var node string
-	node = m.consistent.LocateKey([]byte(key)).String()
+// SetCmdTimeout sets the default command deadline (-cmdtimeout); 0 = none.
+// Can be called at runtime.
+func SetCmdTimeout(d time.Duration) { cmdTimeout.Store(int64(d)) }
+
+// CmdTimeout returns the default command deadline.
+func CmdTimeout() time.Duration { return time.Duration(cmdTimeout.Load()) }
+
+// WithTimeout returns a child of ctx with the default command deadline
+// (-cmdtimeout), or d if it's not zero. No deadline if both are zero.
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d == 0 {
+		d = CmdTimeout()
+	}
+
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// Do sends args to the member that owns key, and waits for the reply, or
+// until ctx is done.
+func (m *Cluster) Do(ctx context.Context, key string, args [][]byte) (interface{}, error) {
+	return m.DoMember(ctx, m.Locate(key), args)
+}
+
+// DoMember is like Do, but sends the command to a specific member (host:port)
+// instead of the member that owns a key.
+func (m *Cluster) DoMember(ctx context.Context, host string, args [][]byte) (interface{}, error) {
+	return m.do(ctx, host, false, args)
+}
+
+// AddReplica registers host as a read replica of the member primary. Used
+// by DoReplica; never part of the hashring.
+func (m *Cluster) AddReplica(primary, host string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	mb, ok := m.members[primary]
+	if !ok {
+		return fmt.Errorf("unknown member %v", primary)
+	}
+
+	if mb.replica == nil {
+		glog.Infof("add replica %v for %v", host, primary)
+		mb.replica = m.newMember(host)
+	}
+
+	return nil
+}
+
+// DoReplica is like Do, but prefers the replica of the member that owns key,
+// if it has one. Only use this for read-only commands.
+func (m *Cluster) DoReplica(ctx context.Context, key string, args [][]byte) (interface{}, error) {
+	return m.do(ctx, m.Locate(key), true, args)
+}
+
+// do sends args to host, or its replica (if replica is true and it has one),
+// coalescing it with identical commands in flight if it's in -coalesce.
+func (m *Cluster) do(ctx context.Context, host string, replica bool, args [][]byte) (interface{}, error) {
+	if coalesced(string(args[0])) {
+		return m.coalesce(ctx, host, replica, args)
+	}
+
+	return m.send(ctx, host, replica, args)
+}
+
+// send queues args to host, or its replica, and waits for the reply.
+func (m *Cluster) send(ctx context.Context, host string, replica bool, args [][]byte) (interface{}, error) {
 	nargs := []interface{}{}
 	if len(args) > 1 {
 		for i := 1; i < len(args); i++ {
@@ -109,20 +217,77 @@ func (m *Cluster) Do(key string, args [][]byte) (interface{}, error) {
 	}
 
 	c := &rcmd{
-		cmd:  string(args[0]),
-		args: nargs,
-		done: make(chan error, 1),
+		ctx:    ctx,
+		cmd:    string(args[0]),
+		args:   nargs,
+		done:   make(chan error, 1),
+		client: clientOf(ctx),
 	}
 
+	// Only for the lookup; a full queue must not hold up AddMember.
 	m.mtx.RLock()
-	m.members[node].queue <- c
+	mb, ok := m.members[host]
+	if ok && replica && mb.replica != nil {
+		mb = mb.replica
+	}
+
 	m.mtx.RUnlock()
-	err := <-c.done
-	return c.reply, err
+	if !ok {
+		return nil, fmt.Errorf("ERR unknown member %v", host)
+	}
+
+	if err := mb.admit(ctx, c); err != nil {
+		if errors.Is(err, ErrBusy) {
+			return nil, err
+		}
+
+		return nil, m.ctxErr(ctx)
+	}
+
+	// done is buffered, so the runner won't block if we leave early.
+	select {
+	case err := <-c.done:
+		if err == ErrTimeout {
+			timeouts.Add(1)
+		}
+
+		return c.reply, err
+	case <-ctx.Done():
+		return nil, m.ctxErr(ctx)
+	}
+}
+
+func (m *Cluster) ctxErr(ctx context.Context) error {
+	err := ctxErr(ctx.Err())
+	if err == ErrTimeout {
+		timeouts.Add(1)
+	}
+
+	return err
+}
+
+// Locate returns the member (host:port) that owns key.
+func (m *Cluster) Locate(key string) string {
+	return m.consistent.LocateKey([]byte(key)).String()
+}
+
+// Members returns all members' host:port, sorted.
+func (m *Cluster) Members() []string {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	hosts := []string{}
+	for k := range m.members {
+		hosts = append(hosts, k)
+	}
+
+	sort.Strings(hosts)
+	return hosts
 }
 
 func (m *Cluster) RandomPing() error {
-	_, err := m.Do(uuid.NewString(), [][]byte{[]byte("PING")})
+	ctx, cancel := WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err := m.Do(ctx, uuid.NewString(), [][]byte{[]byte("PING")})
 	return err
 }
 
@@ -131,10 +296,20 @@ func (m *Cluster) Close() {
 	defer m.mtx.Unlock()
 	for k, v := range m.members {
 		glog.Infof("closing %v...", k)
-		close(v.queue)
-		v.done.Wait()
-		v.client.Close()
+		for _, mb := range []*member{v, v.replica} {
+			if mb == nil {
+				continue
+			}
+
+			mb.close()
+		}
 	}
 }
 
-func NewCluster() *Cluster { return &Cluster{members: map[string]*member{}} }
+func NewCluster() *Cluster {
+	return &Cluster{
+		members: map[string]*member{},
+		Scripts: NewScriptCache(),
+		Near:    NewNearCache(*flags.NearCacheSize, *flags.NearCacheTTL),
+	}
+}
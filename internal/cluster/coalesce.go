@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	coalesceCmds map[string]bool // set once, in main
+	flight       singleflight.Group
+
+	coalescedCmds = metrics.Counter("coalesced_commands")
+)
+
+// SetCoalesce sets the (read-only) commands that are coalesced: concurrent
+// calls with the same arguments, to the same member, share one round trip
+// and reply. Not safe to call once commands are flowing.
+func SetCoalesce(cmds []string) error {
+	m := make(map[string]bool)
+	for _, c := range cmds {
+		c = strings.ToLower(c)
+		if blocking[c] {
+			return fmt.Errorf("invalid -coalesce entry '%v': blocking commands can't be coalesced", c)
+		}
+
+		m[c] = true
+	}
+
+	coalesceCmds = m
+	return nil
+}
+
+// coalesced returns true if cmd is in -coalesce.
+func coalesced(cmd string) bool {
+	return len(coalesceCmds) > 0 && coalesceCmds[strings.ToLower(cmd)]
+}
+
+// coalesce is send, shared with all concurrent callers of the same command.
+// The shared command belongs to none of them: it has the default deadline
+// (-cmdtimeout) and no client (for -clientqueue), and isn't cancelled with
+// whoever started it. Each caller still leaves at its own deadline, and those
+// with time left when it fails with TIMEOUT or BUSY try again on their own.
+func (m *Cluster) coalesce(ctx context.Context, host string, replica bool, args [][]byte) (interface{}, error) {
+	var leader bool
+	ch := flight.DoChan(flightKey(host, replica, args), func() (interface{}, error) {
+		leader = true
+		fctx, cancel := WithTimeout(context.Background(), 0)
+		defer cancel()
+
+		// Our caller can leave before we're done, and its args with it.
+		own := make([][]byte, len(args))
+		for i, a := range args {
+			own[i] = append([]byte(nil), a...)
+		}
+
+		return m.send(fctx, host, replica, own)
+	})
+
+	select {
+	case r := <-ch:
+		if !leader {
+			coalescedCmds.Add(1)
+		}
+
+		retry := errors.Is(r.Err, ErrTimeout) || errors.Is(r.Err, ErrBusy)
+		if retry && ctx.Err() == nil {
+			return m.send(ctx, host, replica, args)
+		}
+
+		return r.Val, r.Err
+	case <-ctx.Done():
+		return nil, m.ctxErr(ctx)
+	}
+}
+
+// flightKey identifies args to host for coalescing; args are length-prefixed,
+// so different splits of the same bytes don't collide.
+func flightKey(host string, replica bool, args [][]byte) string {
+	var b strings.Builder
+	b.WriteString(host)
+	if replica {
+		b.WriteString("+r")
+	}
+
+	for _, a := range args {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Itoa(len(a)))
+		b.WriteByte(':')
+		b.Write(a)
+	}
+
+	return b.String()
+}
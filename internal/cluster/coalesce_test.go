@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFlightKey(t *testing.T) {
+	type call struct {
+		host    string
+		replica bool
+		args    string // split on '|'
+	}
+
+	args := func(s string) [][]byte {
+		var out [][]byte
+		for _, a := range strings.Split(s, "|") {
+			out = append(out, []byte(a))
+		}
+
+		return out
+	}
+
+	for _, tc := range []struct {
+		a, b call
+		same bool
+	}{
+		{call{"h:6379", false, "GET|k"}, call{"h:6379", false, "GET|k"}, true},
+		{call{"h:6379", false, "GET|k"}, call{"h:6380", false, "GET|k"}, false},
+		{call{"h:6379", false, "GET|k"}, call{"h:6379", true, "GET|k"}, false},
+		{call{"h:6379", false, "GET|k"}, call{"h:6379", false, "GET|j"}, false},
+		{call{"h:6379", false, "HGET|a b|c"}, call{"h:6379", false, "HGET|a|b c"}, false},
+		{call{"h:6379", false, "HGET|ab|c"}, call{"h:6379", false, "HGET|a|bc"}, false},
+		{call{"h:6379", false, "GET|k"}, call{"h:6379", false, "GET|k|"}, false},
+		{call{"h:6379", false, "GET|1:k"}, call{"h:6379", false, "GET|k"}, false},
+		{call{"h:6379", false, "GET|"}, call{"h:6379", false, "GET"}, false},
+	} {
+		a := flightKey(tc.a.host, tc.a.replica, args(tc.a.args))
+		b := flightKey(tc.b.host, tc.b.replica, args(tc.b.args))
+		if (a == b) != tc.same {
+			t.Errorf("flightKey(%v) = %q, flightKey(%v) = %q, want same: %v", tc.a, a, tc.b, b, tc.same)
+		}
+	}
+}
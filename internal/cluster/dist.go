@@ -0,0 +1,198 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alphauslabs/jupiter/internal/compress"
+)
+
+// Chunk layouts for DISTGET/DISTSET values.
+const (
+	LayoutHashed = "hashed" // all chunks hashed by the value's key (default)
+	LayoutSpread = "spread" // each chunk hashed by its own key, across members
+)
+
+// ChunkKey returns the key of chunk i of name.
+func ChunkKey(name string, i int) string { return fmt.Sprintf("%v/%v", name, i) }
+
+// ChunkOwner returns the member that owns chunk i of name for layout.
+func (m *Cluster) ChunkOwner(name string, i int, layout string) string {
+	if layout == LayoutSpread {
+		return m.Locate(ChunkKey(name, i))
+	}
+
+	return m.Locate(name)
+}
+
+// GetChunks reads the chunks ids of name, with one MGET per owner, all in
+// parallel. Chunks that don't exist are not in the output; the error is for
+// the first owner that failed, if any, in which case the output is partial.
+func (m *Cluster) GetChunks(ctx context.Context, name, layout string, ids []int) (map[int][]byte, error) {
+	owners := make(map[string][]int)
+	for _, id := range ids {
+		o := m.ChunkOwner(name, id, layout)
+		owners[o] = append(owners[o], id)
+	}
+
+	var w sync.WaitGroup
+	var mtx sync.Mutex
+	var errs []error
+	out := make(map[int][]byte)
+	for host, ids := range owners {
+		w.Add(1)
+		go func(host string, ids []int) {
+			defer w.Done()
+			mgets := [][]byte{[]byte("MGET")}
+			for _, id := range ids {
+				mgets = append(mgets, []byte(ChunkKey(name, id)))
+			}
+
+			v, err := m.DoMember(ctx, host, mgets)
+			l, ok := v.([]interface{})
+			if err == nil && !ok {
+				err = fmt.Errorf("unknown type for %v chunks: %T", name, v)
+			}
+
+			// Decoded before locking, to decompress in parallel.
+			found := make(map[int][]byte)
+			var ferrs []error
+			for i, d := range l {
+				switch d := d.(type) {
+				case nil: // not found
+				case string:
+					b, err := compress.Decode(stringToBytes(d))
+					if err != nil {
+						ferrs = append(ferrs, fmt.Errorf("decode %v failed: %w", ChunkKey(name, ids[i]), err))
+						continue
+					}
+
+					found[ids[i]] = b
+				default:
+					ferrs = append(ferrs, fmt.Errorf("unexpected non-string type for %v, type=%T",
+						ChunkKey(name, ids[i]), d))
+				}
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+
+			errs = append(errs, ferrs...)
+			for id, b := range found {
+				out[id] = b
+			}
+		}(host, ids)
+	}
+
+	w.Wait()
+	if len(errs) > 0 {
+		return out, errs[0]
+	}
+
+	return out, nil
+}
+
+// chunkSizesScript returns, for each key in KEYS, its length and its first
+// ARGV[1] bytes, or -1 if it's not a string.
+var chunkSizesScript = `local out = {}
+for i, k in ipairs(KEYS) do
+  if redis.call('TYPE', k).ok == 'string' then
+    out[i] = {redis.call('STRLEN', k), redis.call('GETRANGE', k, 0, ARGV[1] - 1)}
+  else
+    out[i] = {-1, ''}
+  end
+end
+return out`
+
+// ChunkSizes returns the sizes of the chunks ids of name, as GetChunks would
+// return them (decompressed), with one round trip per owner, all in
+// parallel, without reading them whole, except for the few compressed ones
+// whose header doesn't say. Chunks that don't exist are not in the output;
+// errors are the same as GetChunks'.
+func (m *Cluster) ChunkSizes(ctx context.Context, name, layout string, ids []int) (map[int]int64, error) {
+	owners := make(map[string][]int)
+	for _, id := range ids {
+		o := m.ChunkOwner(name, id, layout)
+		owners[o] = append(owners[o], id)
+	}
+
+	var w sync.WaitGroup
+	var mtx sync.Mutex
+	var errs []error
+	var unknown []int // read whole
+	out := make(map[int]int64)
+	for host, ids := range owners {
+		w.Add(1)
+		go func(host string, ids []int) {
+			defer w.Done()
+			args := [][]byte{[]byte("EVALSHA"), []byte(ScriptSha1(chunkSizesScript)), []byte(fmt.Sprint(len(ids)))}
+			for _, id := range ids {
+				args = append(args, []byte(ChunkKey(name, id)))
+			}
+
+			args = append(args, []byte(fmt.Sprint(compress.SizePrefix)))
+			v, err := m.DoMember(ctx, host, args)
+			if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+				args[0], args[1] = []byte("EVAL"), []byte(chunkSizesScript)
+				v, err = m.DoMember(ctx, host, args)
+			}
+
+			l, ok := v.([]interface{})
+			if err == nil && (!ok || len(l) != len(ids)) {
+				err = fmt.Errorf("unexpected reply for %v chunk sizes: %T", name, v)
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+
+			for i, e := range l {
+				r, _ := e.([]interface{})
+				if len(r) != 2 {
+					continue
+				}
+
+				n, _ := r[0].(int64)
+				prefix, _ := r[1].(string)
+				if n < 0 {
+					continue // not found
+				}
+
+				size, ok := compress.Size(stringToBytes(prefix), n)
+				if !ok {
+					unknown = append(unknown, ids[i])
+					continue
+				}
+
+				out[ids[i]] = size
+			}
+		}(host, ids)
+	}
+
+	w.Wait()
+	if len(unknown) > 0 {
+		found, err := m.GetChunks(ctx, name, layout, unknown)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		for id, b := range found {
+			out[id] = int64(len(b))
+		}
+	}
+
+	if len(errs) > 0 {
+		return out, errs[0]
+	}
+
+	return out, nil
+}
@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/golang/glog"
+)
+
+// NearCacheInput is broadcast to all proxies when keys in their near caches
+// are written, or flushed (Flush is true).
+type NearCacheInput struct {
+	Keys  []string `json:"keys,omitempty"`
+	Flush bool     `json:"flush,omitempty"`
+}
+
+var (
+	nearHits    = metrics.Counter("nearcache_hits")
+	nearMisses  = metrics.Counter("nearcache_misses")
+	nearEvicted = metrics.Counter("nearcache_evictions")
+	nearInvals  = metrics.Counter("nearcache_invalidations")
+)
+
+// NearCache is a size-bounded LRU of values read through this proxy, kept
+// for at most -nearcachettl (our bound for invalidations we miss). Keys are
+// whatever the caller uses; see NearKey.
+//
+// Reads that miss call Reserve before going to the member, then Fill with
+// the value. Invalidations in between remove the reservation, so the value
+// read before the write is never cached.
+type NearCache struct {
+	mtx   sync.Mutex
+	max   int64 // bytes
+	ttl   time.Duration
+	size  int64
+	seq   uint64
+	lru   *list.List // of *nearEntry, most recent first
+	items map[string]*list.Element
+}
+
+type nearEntry struct {
+	key     string
+	value   string
+	token   uint64 // reservation, 0 once filled
+	expires time.Time
+}
+
+func NewNearCache(max int64, ttl time.Duration) *NearCache {
+	return &NearCache{
+		max:   max,
+		ttl:   ttl,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// NearKey returns the near cache key for key in member host; the same key
+// name can have different values in different members.
+func NearKey(host, key string) string { return host + " " + key }
+
+// Get returns the value of key, if cached and not expired.
+func (nc *NearCache) Get(key string) (string, bool) {
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+	el, ok := nc.items[key]
+	if ok {
+		e := el.Value.(*nearEntry)
+		switch {
+		case e.token != 0: // still being read
+		case time.Now().After(e.expires):
+			nc.remove(el)
+		default:
+			nc.lru.MoveToFront(el)
+			nearHits.Add(1)
+			return e.value, true
+		}
+	}
+
+	nearMisses.Add(1)
+	return "", false
+}
+
+// Reserve returns a token for Fill, to call after reading key from its member.
+func (nc *NearCache) Reserve(key string) uint64 {
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+	nc.seq++
+	if el, ok := nc.items[key]; ok {
+		nc.remove(el) // stale, or someone else's reservation; ours wins
+	}
+
+	nc.items[key] = nc.lru.PushFront(&nearEntry{key: key, token: nc.seq})
+	return nc.seq
+}
+
+// Fill caches value for key, if key's reservation is still token, i.e. key
+// was not invalidated since. Values over 1/16 of -nearcachesize are dropped.
+func (nc *NearCache) Fill(key string, token uint64, value string) {
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+	el, ok := nc.items[key]
+	if !ok || el.Value.(*nearEntry).token != token {
+		return
+	}
+
+	if int64(len(value)) > nc.max/16 {
+		nc.remove(el)
+		return
+	}
+
+	e := el.Value.(*nearEntry)
+	e.value, e.token, e.expires = value, 0, time.Now().Add(nc.ttl)
+	nc.size += int64(len(value))
+	for nc.size > nc.max {
+		nc.remove(nc.lru.Back())
+		nearEvicted.Add(1)
+	}
+}
+
+// Drop removes key's reservation token, i.e. when the read failed.
+func (nc *NearCache) Drop(key string, token uint64) {
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+	if el, ok := nc.items[key]; ok && el.Value.(*nearEntry).token == token {
+		nc.remove(el)
+	}
+}
+
+// Invalidate removes keys (and their reservations).
+func (nc *NearCache) Invalidate(keys ...string) {
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+	for _, k := range keys {
+		if el, ok := nc.items[k]; ok {
+			nc.remove(el)
+			nearInvals.Add(1)
+		}
+	}
+}
+
+// Flush removes everything.
+func (nc *NearCache) Flush() {
+	nc.mtx.Lock()
+	defer nc.mtx.Unlock()
+	nc.lru.Init()
+	nc.items = make(map[string]*list.Element)
+	nc.size = 0
+}
+
+func (nc *NearCache) remove(el *list.Element) {
+	e := nc.lru.Remove(el).(*nearEntry)
+	delete(nc.items, e.key)
+	nc.size -= int64(len(e.value))
+}
+
+func doNearCache(cd *ClusterData, e *cloudevents.Event) ([]byte, error) {
+	var in NearCacheInput
+	err := json.Unmarshal(e.Data(), &in)
+	if err != nil {
+		glog.Errorf("Unmarshal failed: %v", err)
+		return nil, err
+	}
+
+	switch {
+	case in.Flush:
+		cd.Cluster.Near.Flush()
+	default:
+		cd.Cluster.Near.Invalidate(in.Keys...)
+	}
+
+	return nil, nil
+}
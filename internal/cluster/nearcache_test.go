@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNearCache(t *testing.T) {
+	type op struct {
+		do    string // reserve, fill, drop, inval, flush, get
+		key   string
+		value string // for fill; for get, the value wanted ("" = miss)
+		token int    // for fill/drop: the token of the nth reserve (from 1), -1 for the last; 0 = a bogus one
+	}
+
+	// fill caches keys, each with itself as value, in order.
+	fill := func(keys ...string) []op {
+		var ops []op
+		for _, k := range keys {
+			ops = append(ops, op{do: "reserve", key: k}, op{do: "fill", key: k, value: k, token: -1})
+		}
+
+		return ops
+	}
+
+	cat := func(ops ...[]op) []op {
+		var all []op
+		for _, o := range ops {
+			all = append(all, o...)
+		}
+
+		return all
+	}
+
+	for _, tc := range []struct {
+		name string
+		max  int64
+		ops  []op
+		size int64 // after ops
+	}{
+		{
+			name: "fill, get",
+			max:  1 << 10,
+			ops: []op{
+				{do: "get", key: "a"},
+				{do: "reserve", key: "a"},
+				{do: "get", key: "a"}, // still being read
+				{do: "fill", key: "a", value: "1", token: 1},
+				{do: "get", key: "a", value: "1"},
+			},
+			size: 1,
+		},
+		{
+			name: "invalidated while reading",
+			max:  1 << 10,
+			ops: []op{
+				{do: "reserve", key: "a"},
+				{do: "inval", key: "a"},
+				{do: "fill", key: "a", value: "old", token: 1},
+				{do: "get", key: "a"},
+			},
+		},
+		{
+			name: "newer reservation wins",
+			max:  1 << 10,
+			ops: []op{
+				{do: "reserve", key: "a"},
+				{do: "reserve", key: "a"},
+				{do: "fill", key: "a", value: "first", token: 1},
+				{do: "get", key: "a"},
+				{do: "fill", key: "a", value: "second", token: 2},
+				{do: "get", key: "a", value: "second"},
+			},
+			size: 6,
+		},
+		{
+			name: "bogus token",
+			max:  1 << 10,
+			ops: []op{
+				{do: "reserve", key: "a"},
+				{do: "fill", key: "a", value: "1", token: 0},
+				{do: "drop", key: "a", token: 0},
+				{do: "fill", key: "a", value: "1", token: 1},
+				{do: "get", key: "a", value: "1"},
+			},
+			size: 1,
+		},
+		{
+			name: "dropped",
+			max:  1 << 10,
+			ops: []op{
+				{do: "reserve", key: "a"},
+				{do: "drop", key: "a", token: 1},
+				{do: "fill", key: "a", value: "1", token: 1},
+				{do: "get", key: "a"},
+			},
+		},
+		{
+			name: "refilled",
+			max:  1 << 10,
+			ops: []op{
+				{do: "reserve", key: "a"},
+				{do: "fill", key: "a", value: "long value", token: 1},
+				{do: "reserve", key: "a"}, // replaces the stale one
+				{do: "fill", key: "a", value: "v2", token: 2},
+				{do: "get", key: "a", value: "v2"},
+			},
+			size: 2,
+		},
+		{
+			name: "too large",
+			max:  64,
+			ops: []op{
+				{do: "reserve", key: "a"},
+				{do: "fill", key: "a", value: "12345", token: 1}, // over 64/16
+				{do: "get", key: "a"},
+				{do: "reserve", key: "b"},
+				{do: "fill", key: "b", value: "1234", token: 2},
+				{do: "get", key: "b", value: "1234"},
+			},
+			size: 4,
+		},
+		{
+			name: "least recently used evicted",
+			max:  64, // 4-byte values: 16 of them
+			ops: cat(
+				fill("k-00", "k-01", "k-02", "k-03", "k-04", "k-05", "k-06", "k-07",
+					"k-08", "k-09", "k-10", "k-11", "k-12", "k-13", "k-14", "k-15"),
+				[]op{{do: "get", key: "k-00", value: "k-00"}}, // now k-01 is the oldest
+				fill("k-16", "k-17"),
+				[]op{
+					{do: "get", key: "k-01"},
+					{do: "get", key: "k-02"},
+					{do: "get", key: "k-00", value: "k-00"},
+					{do: "get", key: "k-03", value: "k-03"},
+					{do: "get", key: "k-17", value: "k-17"},
+				},
+			),
+			size: 64,
+		},
+		{
+			name: "invalidate, flush",
+			max:  1 << 10,
+			ops: cat(
+				fill("aa", "bb", "cc"),
+				[]op{
+					{do: "inval", key: "aa"},
+					{do: "inval", key: "x"},
+					{do: "get", key: "aa"},
+					{do: "get", key: "bb", value: "bb"},
+					{do: "flush"},
+					{do: "get", key: "bb"},
+				},
+				fill("c"),
+			),
+			size: 1,
+		},
+	} {
+		nc := NewNearCache(tc.max, time.Minute)
+		var tokens []uint64
+		token := func(n int) uint64 {
+			switch n {
+			case 0:
+				return 1 << 60
+			case -1:
+				return tokens[len(tokens)-1]
+			}
+
+			return tokens[n-1]
+		}
+
+		for i, o := range tc.ops {
+			switch o.do {
+			case "reserve":
+				tokens = append(tokens, nc.Reserve(o.key))
+			case "fill":
+				nc.Fill(o.key, token(o.token), o.value)
+			case "drop":
+				nc.Drop(o.key, token(o.token))
+			case "inval":
+				nc.Invalidate(o.key)
+			case "flush":
+				nc.Flush()
+			case "get":
+				v, ok := nc.Get(o.key)
+				if ok != (o.value != "") || v != o.value {
+					t.Errorf("%v: [%v] Get(%q) = %q, %v, want %q", tc.name, i, o.key, v, ok, o.value)
+				}
+			}
+		}
+
+		if nc.size != tc.size {
+			t.Errorf("%v: size = %v, want %v", tc.name, nc.size, tc.size)
+		}
+
+		if len(nc.items) != nc.lru.Len() {
+			t.Errorf("%v: %v items, %v in the lru", tc.name, len(nc.items), nc.lru.Len())
+		}
+	}
+}
+
+func TestNearCacheTTL(t *testing.T) {
+	nc := NewNearCache(1<<10, 50*time.Millisecond)
+	nc.Fill("a", nc.Reserve("a"), "1")
+	if v, ok := nc.Get("a"); !ok || v != "1" {
+		t.Fatalf("Get = %q, %v, want \"1\"", v, ok)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if v, ok := nc.Get("a"); ok {
+		t.Errorf("Get after ttl = %q, want a miss", v)
+	}
+
+	if nc.size != 0 || len(nc.items) != 0 {
+		t.Errorf("expired entry still held: size %v, %v items", nc.size, len(nc.items))
+	}
+}
+
+func TestNearKey(t *testing.T) {
+	if a, b := NearKey("h1:6379", "k"), NearKey("h2:6379", "k"); a == b {
+		t.Errorf("NearKey is the same for two members: %q", a)
+	}
+
+	if k := NearKey("h1:6379", "a b"); !strings.HasSuffix(k, "a b") {
+		t.Errorf("NearKey(%q) = %q", "a b", k)
+	}
+}
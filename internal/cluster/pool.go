@@ -0,0 +1,336 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"github.com/golang/glog"
+	goredisv9 "github.com/redis/go-redis/v9"
+)
+
+var (
+	runnersStarted = metrics.Counter("runners_started")
+	runnersStopped = metrics.Counter("runners_stopped")
+	pipelines      = metrics.Counter("pipelines")
+	pipelinedCmds  = metrics.Counter("pipelined_commands")
+)
+
+// Each member's queue is served by an adaptive number of runners (each with
+// its own connection from the member's pool), between -minrunners and
+// -maxactive. Runners send whatever is queued (up to -pipelinebatch) as one
+// pipeline. A runner is added when there's more queued than the runners can
+// take in their next pipeline; busy runners count, as they're back after a
+// round trip, except those in a blocking command (i.e. BLPOP), which can be
+// gone for long. So all runners blocked means a new one for anything queued.
+// Runners idle for -runneridle exit, as long as there are still enough for
+// retireHeadroom times the observed load, and one stays free while others
+// are busy; the headroom keeps the pool from shrinking back to where the
+// next burst grows it again. That load is the moving average of the commands
+// in flight (queued or running), which, by Little's law, is the arrival rate
+// times the latency; so slower members keep more runners.
+
+// retireHeadroom is how many times the observed load idle runners keep room
+// for before they exit.
+const retireHeadroom = 1.5
+
+// start starts the minimum runners for mb.
+func (mb *member) start() {
+	for i := 0; i < *flags.MinRunners; i++ {
+		mb.spawn()
+	}
+}
+
+// spawn starts a new runner, unless we're at -maxactive already.
+func (mb *member) spawn() bool {
+	for {
+		n := mb.runners.Load()
+		if n >= int32(*flags.MaxActive) {
+			return false
+		}
+
+		if mb.runners.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+
+	id := fmt.Sprintf("%v/%04d", mb.host, mb.seq.Add(1))
+	runnersStarted.Add(1)
+	mb.done.Add(1)
+	go mb.run(id)
+	return true
+}
+
+// queued accounts for a command just pushed to mb's queue, adding a runner if
+// the runners that aren't blocked can't take all that's queued in their next
+// pipeline.
+func (mb *member) queued() {
+	mb.observe(mb.inflight.Add(1))
+	select {
+	case <-mb.stop:
+		mb.drain() // closed while we were queueing it
+		return
+	default:
+	}
+
+	ready := int(mb.runners.Load() - mb.blocked.Load())
+	if len(mb.queue) > ready*perRunner() {
+		mb.spawn()
+	}
+}
+
+// observe updates the moving average of commands in flight with n.
+func (mb *member) observe(n int64) {
+	for {
+		old := mb.load.Load()
+		v := math.Float64frombits(old)*0.95 + float64(n)*0.05
+		if mb.load.CompareAndSwap(old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+// retire returns true if an idle runner can exit, and accounts for it. Not
+// if it's the only free one: the others may be blocked for a long time, and
+// the load (mostly them) doesn't say so.
+func (mb *member) retire() bool {
+	load := math.Float64frombits(mb.load.Load()) * retireHeadroom
+	floor := int32(math.Ceil(load / float64(perRunner())))
+	if floor < int32(*flags.MinRunners) {
+		floor = int32(*flags.MinRunners)
+	}
+
+	n := mb.runners.Load()
+	if n <= floor || mb.free.Load() == 0 {
+		return false
+	}
+
+	return mb.runners.CompareAndSwap(n, n-1)
+}
+
+// run executes the commands in mb's queue until mb is closed, or we've been
+// idle long enough to retire.
+func (mb *member) run(id string) {
+	defer mb.done.Done()
+	glog.V(2).Infof("runner %v started", id)
+	idle := time.NewTicker(*flags.RunnerIdle)
+	defer idle.Stop()
+	last := time.Now()
+	for {
+		mb.free.Add(1)
+		select {
+		case <-mb.stop:
+			mb.free.Add(-1)
+			mb.runners.Add(-1)
+			return
+		case j := <-mb.queue:
+			mb.free.Add(-1)
+			batch, alone := mb.batch(j)
+			mb.exec(id, batch)
+			if alone != nil {
+				mb.exec(id, []*rcmd{alone})
+				batch = append(batch, alone)
+			}
+
+			mb.observe(mb.inflight.Add(-int64(len(batch))))
+			last = time.Now()
+		case <-idle.C:
+			mb.free.Add(-1) // while we check
+			if time.Since(last) >= *flags.RunnerIdle && mb.retire() {
+				runnersStopped.Add(1)
+				glog.V(2).Infof("runner %v retired", id)
+				return
+			}
+		}
+	}
+}
+
+// batch returns j, plus whatever else is queued (or arrives within
+// -pipelinelinger), up to -pipelinebatch commands, for one pipeline. Blocking
+// commands would hold up the others, so the first one found is returned on
+// its own, to be run after the batch.
+func (mb *member) batch(j *rcmd) ([]*rcmd, *rcmd) {
+	batch := []*rcmd{j}
+	if !pipelined(j.cmd) {
+		return batch, nil
+	}
+
+	var linger <-chan time.Time
+	if *flags.PipelineLinger > 0 {
+		t := time.NewTimer(*flags.PipelineLinger)
+		defer t.Stop()
+		linger = t.C
+	}
+
+	for len(batch) < *flags.PipelineBatch {
+		var next *rcmd
+		select {
+		case next = <-mb.queue:
+		default:
+			if linger == nil {
+				return batch, nil
+			}
+
+			select {
+			case next = <-mb.queue:
+			case <-linger:
+				return batch, nil
+			}
+		}
+
+		if !pipelined(next.cmd) {
+			return batch, next
+		}
+
+		batch = append(batch, next)
+	}
+
+	return batch, nil
+}
+
+// exec runs batch, as a pipeline if there's more than one, and sends back
+// the replies.
+func (mb *member) exec(id string, batch []*rcmd) {
+	live := batch[:0:0]
+	for _, j := range batch {
+		if err := j.ctx.Err(); err != nil {
+			// Expired (or caller gone) while queued; don't bother.
+			dropped.Add(1)
+			mb.reply(j, ctxErr(err))
+			continue
+		}
+
+		j.runner = id
+		live = append(live, j)
+	}
+
+	switch len(live) {
+	case 0:
+		return
+	case 1:
+		j := live[0]
+		if blocking[strings.ToLower(j.cmd)] {
+			mb.blocked.Add(1)
+			defer mb.blocked.Add(-1)
+		}
+
+		out, err := mb.client.Do(j.ctx, append([]interface{}{j.cmd}, j.args...)...).Result()
+		j.reply = out
+		mb.reply(j, cmdErr(j, err))
+		return
+	}
+
+	pipelines.Add(1)
+	pipelinedCmds.Add(int64(len(live)))
+	ctx, cancel := batchContext(live)
+	defer cancel()
+	pipe := mb.client.Pipeline()
+	cmds := make([]*goredisv9.Cmd, len(live))
+	for i, j := range live {
+		cmds[i] = pipe.Do(ctx, append([]interface{}{j.cmd}, j.args...)...)
+	}
+
+	pipe.Exec(ctx) // errors are in each cmd
+	for i, j := range live {
+		out, err := cmds[i].Result()
+		j.reply = out
+		mb.reply(j, cmdErr(j, err))
+	}
+}
+
+// close stops mb's runners, then fails whatever is still queued with
+// ErrClosed, so callers without a deadline don't wait forever.
+func (mb *member) close() {
+	close(mb.stop)
+	mb.done.Wait()
+	mb.drain()
+	mb.client.Close()
+}
+
+// drain fails all commands in mb's queue with ErrClosed.
+func (mb *member) drain() {
+	for {
+		select {
+		case j := <-mb.queue:
+			mb.inflight.Add(-1)
+			mb.reply(j, ErrClosed)
+		default:
+			return
+		}
+	}
+}
+
+// reply sends err (and j.reply) back to j's caller.
+func (mb *member) reply(j *rcmd, err error) {
+	mb.release(j)
+	j.done <- err
+}
+
+// cmdErr returns err, or ErrTimeout if j's deadline expired.
+func cmdErr(j *rcmd, err error) error {
+	if err != nil && j.ctx.Err() != nil {
+		return ctxErr(j.ctx.Err())
+	}
+
+	return err
+}
+
+// batchContext returns a context for a pipeline of batch: with the latest
+// deadline among them, so none is cut short, or none if any has none.
+func batchContext(batch []*rcmd) (context.Context, context.CancelFunc) {
+	var last time.Time
+	for _, j := range batch {
+		d, ok := j.ctx.Deadline()
+		if !ok {
+			return context.WithCancel(context.Background())
+		}
+
+		if d.After(last) {
+			last = d
+		}
+	}
+
+	return context.WithDeadline(context.Background(), last)
+}
+
+// blocking are the commands that can block a connection; never pipelined.
+var blocking = map[string]bool{
+	"blpop": true, "brpop": true, "brpoplpush": true, "blmove": true, "blmpop": true,
+	"bzpopmin": true, "bzpopmax": true, "bzmpop": true, "xread": true, "xreadgroup": true,
+	"wait": true, "waitaof": true,
+}
+
+// perRunner returns how many commands a runner takes at a time.
+func perRunner() int {
+	if *flags.PipelineBatch > 1 {
+		return *flags.PipelineBatch
+	}
+
+	return 1
+}
+
+// pipelined returns true if cmd can share a pipeline with others.
+func pipelined(cmd string) bool {
+	return *flags.PipelineBatch > 1 && !blocking[strings.ToLower(cmd)]
+}
+
+// Runners returns the current number of runners per member (replicas
+// included), for monitoring.
+func (m *Cluster) Runners() map[string]int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	out := make(map[string]int)
+	for _, v := range m.members {
+		for _, mb := range []*member{v, v.replica} {
+			if mb != nil {
+				out[mb.host] = int(mb.runners.Load())
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alphauslabs/jupiter/internal/flags"
+	goredisv9 "github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+)
+
+// benchServer starts a minimal in-memory Redis (GET, SET, PING) on loopback,
+// for the duration of b. Returns its address, and its open connections.
+func benchServer(b *testing.B) (string, *atomic.Int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var mtx sync.RWMutex
+	var conns atomic.Int64
+	kv := make(map[string][]byte)
+	go redcon.Serve(ln,
+		func(conn redcon.Conn, cmd redcon.Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "get":
+				mtx.RLock()
+				v, ok := kv[string(cmd.Args[1])]
+				mtx.RUnlock()
+				if !ok {
+					conn.WriteNull()
+					return
+				}
+
+				conn.WriteBulk(v)
+			case "set":
+				mtx.Lock()
+				kv[string(cmd.Args[1])] = append([]byte(nil), cmd.Args[2]...)
+				mtx.Unlock()
+				conn.WriteString("OK")
+			case "ping":
+				conn.WriteString("PONG")
+			default:
+				conn.WriteError(fmt.Sprintf("ERR unknown command '%s'", cmd.Args[0]))
+			}
+		},
+		func(redcon.Conn) bool { conns.Add(1); return true },
+		func(redcon.Conn, error) { conns.Add(-1) },
+	)
+
+	b.Cleanup(func() { ln.Close() })
+	return ln.Addr().String(), &conns
+}
+
+// BenchmarkRunners compares what we had before runners were adaptive (fixed
+// at -maxactive, one command at a time), with the defaults (-minrunners to
+// -maxactive, pipelined), with a mix of GETs and SETs at increasing
+// concurrency. Besides time and allocations per command, reports the
+// runners, connections to the member, and heap and stack in use by the
+// cluster, at the end.
+func BenchmarkRunners(b *testing.B) {
+	minRunners, batch := *flags.MinRunners, *flags.PipelineBatch
+	defer func() { *flags.MinRunners, *flags.PipelineBatch = minRunners, batch }()
+	for _, mode := range []string{"baseline", "adaptive"} {
+		for _, conc := range []int{1, 16, 128, 512} {
+			b.Run(fmt.Sprintf("%v/conc=%v", mode, conc), func(b *testing.B) {
+				*flags.MinRunners, *flags.PipelineBatch = minRunners, batch
+				if mode == "baseline" {
+					*flags.MinRunners, *flags.PipelineBatch = *flags.MaxActive, 1
+				}
+
+				host, conns := benchServer(b)
+				heap, stack := benchMem()
+				c := NewCluster()
+				defer c.Close()
+				c.AddMember(host)
+				b.ReportAllocs()
+				benchDo(b, c, conc)
+				h, s := benchMem()
+				b.ReportMetric(float64(c.Runners()[host]), "runners")
+				b.ReportMetric(float64(conns.Load()), "conns")
+				b.ReportMetric(float64(h-heap), "heap-B")
+				b.ReportMetric(float64(s-stack), "stack-B")
+			})
+		}
+	}
+}
+
+// benchMem returns the heap and stack in use, after a GC.
+func benchMem() (int64, int64) {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse), int64(ms.StackInuse)
+}
+
+// benchDo sends b.N commands to c, from conc goroutines; one in four is a
+// SET, the rest are GETs.
+func benchDo(b *testing.B, c *Cluster, conc int) {
+	var next atomic.Int64
+	var w sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < conc; g++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(b.N) {
+					return
+				}
+
+				key := []byte(fmt.Sprintf("bench/key%04d", i%1000))
+				args := [][]byte{[]byte("GET"), key}
+				if i%4 == 0 {
+					args = [][]byte{[]byte("SET"), key, []byte("value")}
+				}
+
+				ctx, cancel := WithTimeout(context.Background(), 0)
+				_, err := c.Do(ctx, string(key), args)
+				cancel()
+				if err != nil && err != goredisv9.Nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	w.Wait()
+	b.StopTimer()
+}
@@ -0,0 +1,139 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/golang/glog"
+)
+
+const (
+	ScriptOpLoad   = "load"
+	ScriptOpDelete = "delete"
+	ScriptOpFlush  = "flush"
+	ScriptOpGet    = "get"
+
+	ScriptKindLua      = "script"
+	ScriptKindFunction = "function"
+)
+
+// ScriptCacheInput is broadcast to all proxies so they share the same script
+// cache. For Lua scripts, Name is the SHA1 digest; for functions, it's the
+// library name.
+type ScriptCacheInput struct {
+	Op   string `json:"op"`
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+	Body string `json:"body,omitempty"`
+}
+
+// ScriptCache keeps the bodies of Lua scripts and function libraries that went
+// through the proxy, so we can load them again into members that lost them,
+// i.e. after a restart.
+type ScriptCache struct {
+	mtx     sync.RWMutex
+	scripts map[string]string // sha1 -> body
+	libs    map[string]string // library name -> code
+}
+
+func (sc *ScriptCache) m(kind string) map[string]string {
+	if kind == ScriptKindFunction {
+		return sc.libs
+	}
+
+	return sc.scripts
+}
+
+// key returns the cache key for name: SHA1 digests are hex, which EVALSHA
+// takes in any case, but library names are case-sensitive.
+func (sc *ScriptCache) key(kind, name string) string {
+	if kind == ScriptKindFunction {
+		return name
+	}
+
+	return strings.ToLower(name)
+}
+
+func (sc *ScriptCache) Put(kind, name, body string) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.m(kind)[sc.key(kind, name)] = body
+}
+
+func (sc *ScriptCache) Get(kind, name string) (string, bool) {
+	sc.mtx.RLock()
+	defer sc.mtx.RUnlock()
+	v, ok := sc.m(kind)[sc.key(kind, name)]
+	return v, ok
+}
+
+func (sc *ScriptCache) Delete(kind, name string) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	delete(sc.m(kind), sc.key(kind, name))
+}
+
+func (sc *ScriptCache) Flush(kind string) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	switch kind {
+	case ScriptKindFunction:
+		sc.libs = make(map[string]string)
+	default:
+		sc.scripts = make(map[string]string)
+	}
+}
+
+// Libs returns a copy of all cached function libraries.
+func (sc *ScriptCache) Libs() map[string]string {
+	sc.mtx.RLock()
+	defer sc.mtx.RUnlock()
+	m := make(map[string]string)
+	for k, v := range sc.libs {
+		m[k] = v
+	}
+
+	return m
+}
+
+func NewScriptCache() *ScriptCache {
+	return &ScriptCache{
+		scripts: make(map[string]string),
+		libs:    make(map[string]string),
+	}
+}
+
+// ScriptSha1 returns the digest Redis uses for EVALSHA.
+func ScriptSha1(body string) string {
+	h := sha1.Sum([]byte(body))
+	return hex.EncodeToString(h[:])
+}
+
+func doScriptCache(cd *ClusterData, e *cloudevents.Event) ([]byte, error) {
+	var in ScriptCacheInput
+	err := json.Unmarshal(e.Data(), &in)
+	if err != nil {
+		glog.Errorf("Unmarshal failed: %v", err)
+		return nil, err
+	}
+
+	sc := cd.Cluster.Scripts
+	switch in.Op {
+	case ScriptOpLoad:
+		sc.Put(in.Kind, in.Name, in.Body)
+	case ScriptOpDelete:
+		sc.Delete(in.Kind, in.Name)
+	case ScriptOpFlush:
+		sc.Flush(in.Kind)
+	case ScriptOpGet:
+		if v, ok := sc.Get(in.Kind, in.Name); ok {
+			return []byte(v), nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScriptCache(t *testing.T) {
+	sha := ScriptSha1("return 1")
+	for _, tc := range []struct {
+		kind, put, get string
+		found          bool
+	}{
+		{ScriptKindLua, sha, sha, true},
+		{ScriptKindLua, sha, "0" + sha[1:], false},
+		{ScriptKindLua, sha, strings.ToUpper(sha), true}, // EVALSHA takes either
+		{ScriptKindLua, strings.ToUpper(sha), sha, true},
+		{ScriptKindFunction, "mylib", "mylib", true},
+		{ScriptKindFunction, "myLib", "myLib", true},
+		{ScriptKindFunction, "myLib", "mylib", false}, // library names are case-sensitive
+		{ScriptKindFunction, "mylib", "MYLIB", false},
+		{ScriptKindFunction, sha, sha, true},
+		{ScriptKindLua, "lib", "lib", true},
+	} {
+		sc := NewScriptCache()
+		sc.Put(tc.kind, tc.put, "body")
+		if _, ok := sc.Get(tc.kind, tc.get); ok != tc.found {
+			t.Errorf("Put(%v, %q), Get(%q) found = %v, want %v", tc.kind, tc.put, tc.get, ok, tc.found)
+		}
+
+		other := ScriptKindFunction
+		if tc.kind == other {
+			other = ScriptKindLua
+		}
+
+		if _, ok := sc.Get(other, tc.put); ok {
+			t.Errorf("Put(%v, %q) found as a %v", tc.kind, tc.put, other)
+		}
+
+		sc.Delete(tc.kind, tc.get)
+		if _, ok := sc.Get(tc.kind, tc.put); ok == tc.found {
+			t.Errorf("Put(%v, %q), Delete(%q) found = %v, want %v", tc.kind, tc.put, tc.get, ok, !tc.found)
+		}
+	}
+}
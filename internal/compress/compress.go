@@ -0,0 +1,121 @@
+// Package compress handles the compressed values we store in Redis. These
+// have a 5-byte header, our magic bytes and the codec, followed by the
+// payload. Values without the header are returned as is.
+package compress
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported codecs.
+const (
+	Zstd   = "zstd"
+	Snappy = "snappy"
+)
+
+// Codec ids in the header. Raw is for values that would look like ours but
+// aren't, i.e. stored as is, after the header.
+const (
+	idRaw    = 'r'
+	idZstd   = 'z'
+	idSnappy = 's'
+)
+
+const magic = "\x00JPZ"
+
+var (
+	// Both are safe for concurrent use with EncodeAll/DecodeAll.
+	zenc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	zdec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// Valid returns true if codec is supported.
+func Valid(codec string) bool { return codec == Zstd || codec == Snappy }
+
+// Encoded returns true if b has our header.
+func Encoded(b []byte) bool { return len(b) > len(magic) && string(b[:len(magic)]) == magic }
+
+// EncodedString is Encoded for strings.
+func EncodedString(s string) bool { return len(s) > len(magic) && s[:len(magic)] == magic }
+
+// Encode compresses b with codec. If codec is empty, or the result is not
+// smaller, b is returned as is, unless it looks like one of ours (then it's
+// stored raw, with a header). Returns true if b was compressed.
+func Encode(codec string, b []byte) ([]byte, bool) {
+	var out []byte
+	switch codec {
+	case Zstd:
+		out = zenc.EncodeAll(b, header(idZstd, len(b)/2))
+	case Snappy:
+		out = snappy.Encode(nil, b)
+		out = append(header(idSnappy, len(out)), out...)
+	}
+
+	switch {
+	case out != nil && len(out) < len(b):
+		return out, true
+	case Encoded(b):
+		return append(header(idRaw, len(b)), b...), false
+	default:
+		return b, false
+	}
+}
+
+// SizePrefix is how many of a stored value's first bytes Size needs.
+const SizePrefix = len(magic) + 1 + zstd.HeaderMaxSize
+
+// Size returns the original size of a value stored as n bytes, from prefix,
+// its first SizePrefix bytes (or all of them, if shorter), without decoding
+// it. Returns false if it can't tell (i.e. small zstd frames don't have it).
+func Size(prefix []byte, n int64) (int64, bool) {
+	if !Encoded(prefix) {
+		return n, true
+	}
+
+	payload := prefix[len(magic)+1:]
+	switch prefix[len(magic)] {
+	case idRaw:
+		return n - int64(len(magic)+1), true
+	case idSnappy:
+		l, err := snappy.DecodedLen(payload)
+		return int64(l), err == nil
+	case idZstd:
+		var h zstd.Header
+		if err := h.Decode(payload); err != nil || !h.HasFCS {
+			return 0, false
+		}
+
+		return int64(h.FrameContentSize), true
+	default:
+		return 0, false
+	}
+}
+
+// Decode returns the original value of b, or b as is, if it has no header.
+func Decode(b []byte) ([]byte, error) {
+	if !Encoded(b) {
+		return b, nil
+	}
+
+	payload := b[len(magic)+1:]
+	switch b[len(magic)] {
+	case idRaw:
+		return payload, nil
+	case idZstd:
+		return zdec.DecodeAll(payload, nil)
+	case idSnappy:
+		return snappy.Decode(nil, payload)
+	default:
+		return nil, fmt.Errorf("unknown codec id %q", b[len(magic)])
+	}
+}
+
+// header returns our header for codec id, with room for n more bytes.
+func header(id byte, n int) []byte {
+	h := make([]byte, 0, len(magic)+1+n)
+	h = append(h, magic...)
+	return append(h, id)
+}
@@ -0,0 +1,112 @@
+package compress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	long := []byte(strings.Repeat("jupiter ", 128))
+	for _, tc := range []struct {
+		name       string
+		codec      string
+		in         []byte
+		compressed bool
+		header     bool // out has our header
+		id         byte // and this codec id
+		same       bool // out is in as is
+	}{
+		{name: "zstd", codec: Zstd, in: long, compressed: true, header: true, id: idZstd},
+		{name: "snappy", codec: Snappy, in: long, compressed: true, header: true, id: idSnappy},
+		{name: "no codec", codec: "", in: long, same: true},
+		{name: "doesn't shrink", codec: Zstd, in: []byte("abc"), same: true},
+		{name: "empty", codec: Snappy, in: []byte{}, same: true},
+		{name: "magic, no codec", codec: "", in: []byte(magic + "zabc"), header: true, id: idRaw},
+		{name: "magic, doesn't shrink", codec: Zstd, in: []byte(magic + "s"), header: true, id: idRaw},
+		{name: "magic only", codec: "", in: []byte(magic), same: true}, // too short to be ours
+	} {
+		out, ok := Encode(tc.codec, tc.in)
+		if ok != tc.compressed {
+			t.Errorf("%v: compressed = %v, want %v", tc.name, ok, tc.compressed)
+		}
+
+		if tc.same && !bytes.Equal(out, tc.in) {
+			t.Errorf("%v: out = %q, want as is", tc.name, out)
+		}
+
+		if Encoded(out) != tc.header {
+			t.Errorf("%v: header = %v, want %v", tc.name, Encoded(out), tc.header)
+		}
+
+		if tc.header && out[len(magic)] != tc.id {
+			t.Errorf("%v: codec id = %q, want %q", tc.name, out[len(magic)], tc.id)
+		}
+
+		back, err := Decode(out)
+		if err != nil || !bytes.Equal(back, tc.in) {
+			t.Errorf("%v: Decode = %q, %v, want %q", tc.name, back, err, tc.in)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "plain", want: "plain"},
+		{in: "", want: ""},
+		{in: magic, want: magic}, // no codec id; not ours
+		{in: magic + "rvalue", want: "value"},
+		{in: magic + "r", want: ""}, // header, empty payload
+		{in: magic + "xvalue", err: true},
+		{in: magic + "zgarbage", err: true},
+	} {
+		got, err := Decode([]byte(tc.in))
+		switch {
+		case tc.err:
+			if err == nil {
+				t.Errorf("Decode(%q) = %q, want error", tc.in, got)
+			}
+		case err != nil:
+			t.Errorf("Decode(%q) failed: %v", tc.in, err)
+		case string(got) != tc.want:
+			t.Errorf("Decode(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	long := []byte(strings.Repeat("jupiter ", 4096))
+	small := []byte(strings.Repeat("j", 200)) // zstd frames under 256 bytes have no size
+	for _, tc := range []struct {
+		name  string
+		codec string
+		in    []byte
+		ok    bool
+	}{
+		{"plain", "", long, true},
+		{"raw", "", []byte(magic + "zabc"), true},
+		{"zstd", Zstd, long, true},
+		{"zstd, small", Zstd, small, false},
+		{"snappy", Snappy, long, true},
+		{"snappy, small", Snappy, small, true},
+		{"empty", "", []byte{}, true},
+	} {
+		out, _ := Encode(tc.codec, tc.in)
+		prefix := out
+		if len(prefix) > SizePrefix {
+			prefix = prefix[:SizePrefix]
+		}
+
+		n, ok := Size(prefix, int64(len(out)))
+		switch {
+		case ok != tc.ok:
+			t.Errorf("%v: Size ok = %v, want %v", tc.name, ok, tc.ok)
+		case ok && n != int64(len(tc.in)):
+			t.Errorf("%v: Size = %v, want %v", tc.name, n, len(tc.in))
+		}
+	}
+}
@@ -2,11 +2,13 @@ package flags
 
 import (
 	"flag"
+	"time"
 )
 
 var (
 	Test              = flag.Bool("test", false, "Scratch pad, anything")
 	Members           = flag.String("members", "", "Initial Redis members, comma-separated, fmt: [passwd@]host:port")
+	Replicas          = flag.String("replicas", "", "Optional read replicas for members, comma-separated, fmt: {member}={host:port}")
 	Partitions        = flag.Int("partitions", 27_103, "Partition count for our consistent hashring")
 	ReplicationFactor = flag.Int("replicationfactor", 10, "Replication factor for our consistent hashring")
 	Database          = flag.String("db", "", "Spanner database, fmt: projects/{v}/instances/{v}/databases/{v}")
@@ -14,5 +16,40 @@ var (
 	LockName          = flag.String("lockname", "jupiter", "Lock name for spindle")
 	LogTable          = flag.String("logtable", "jupiter_store", "Spanner table for hedge store/log")
 	MaxIdle           = flag.Int("maxidle", 3, "Maximum idle connections to jupiter")
-	MaxActive         = flag.Int("maxactive", 1_000, "Maximum active connections to jupiter")
+	MaxActive         = flag.Int("maxactive", 1_000, "Maximum runners (and connections) per Redis member")
+	MinRunners        = flag.Int("minrunners", 4, "Minimum runners (and idle connections) per Redis member, at least 1")
+	PipelineBatch     = flag.Int("pipelinebatch", 64, "Maximum queued commands a runner sends to a member as one pipeline; 1 disables pipelining")
+	PipelineLinger    = flag.Duration("pipelinelinger", 0, "How long a runner waits for more commands to fill a pipeline; 0 = only what's already queued")
+	RunnerIdle        = flag.Duration("runneridle", time.Second*30, "How long a runner can be idle before it exits, if above -minrunners and the current load")
+	QueueSize         = flag.Int("queuesize", 10_000, "Maximum commands queued per Redis member")
+	EnqueueTimeout    = flag.Duration("enqueuetimeout", time.Millisecond*100, "How long a command waits for room in a full member queue before failing with BUSY; 0 = fail at once")
+	ClientQueue       = flag.Int("clientqueue", 1_000, "Maximum commands in flight per client connection per Redis member, beyond which the client's commands fail with BUSY; 0 = no limit")
+	ReadTimeout       = flag.Duration("readtimeout", time.Minute*2, "Read timeout for connections to Redis members")
+	WriteTimeout      = flag.Duration("writetimeout", time.Minute*2, "Write timeout for connections to Redis members")
+	PoolTimeout       = flag.Duration("pooltimeout", time.Minute*3, "How long to wait for a free connection to a Redis member")
+	CmdTimeout        = flag.Duration("cmdtimeout", time.Second*30, "Default deadline for each proxied command (queueing included), 0 = none; override with timeout=")
+	ChunkSize         = flag.Int("chunksize", 1<<20, "Default chunk size (bytes) for DISTSET")
+	ChunkLayout       = flag.String("chunklayout", "hashed", "Default chunk layout for DISTSET: hashed (all chunks in the key's member) or spread (each chunk hashed on its own)")
+	AutoChunk         = flag.Int("autochunk", 0, "SET values larger than this (bytes) are stored as DISTSET values, and reassembled on GET; 0 = disabled")
+	DistRetries       = flag.Int("distretries", 3, "How many times DISTGET reassigns chunks that fleet members failed to return")
+	DistWindow        = flag.Int("distwindow", 8, "How many chunks DISTGET reads from fleet members ahead of the one it's sending to the client")
+	DistPeerTimeout   = flag.Duration("distpeertimeout", time.Second*2, "How long DISTGET waits for each message from a fleet member before reassigning its chunks; capped to a share of the command deadline")
+	Compress          = flag.String("compress", "", "Compress values of keys with these prefixes, comma-separated, fmt: {prefix}={zstd|snappy}; longest prefix wins")
+	Coalesce          = flag.String("coalesce", "", "Read-only commands (comma-separated, i.e. get,hgetall) whose concurrent identical calls share one round trip and reply")
+	NearCache         = flag.String("nearcache", "", "Cache GET values of keys with these prefixes (comma-separated) in each proxy, invalidated on writes through any proxy")
+	NearCacheSize     = flag.Int64("nearcachesize", 64<<20, "Maximum size (bytes) of the values in each proxy's -nearcache")
+	NearCacheTTL      = flag.Duration("nearcachettl", time.Second*5, "Maximum time a -nearcache value is served, to bound staleness from missed invalidations")
+	CompressMin       = flag.Int("compressmin", 1024, "Values smaller than this (bytes) are not compressed")
+	RateLimit         = flag.Float64("ratelimit", 0, "Maximum gRPC requests per second, 0 = unlimited")
+	RateBurst         = flag.Int("rateburst", 100, "Burst size for -ratelimit")
+	StrictRoute       = flag.Bool("strictroute", false, "If true, trailing hash=/index= args are not parsed by default; use JUPITER.ROUTE instead")
+	RedisAddr         = flag.String("redisaddr", ":6379", "Listen address for the Redis proxy, fmt: [host]:port, or unix:{path} for a Unix socket")
+	MemcacheAddr      = flag.String("memcacheaddr", "", "Optional listen address for the memcached (text protocol) front-end, fmt: [host]:port, or unix:{path}")
+	MemcacheMaxValue  = flag.Int("memcachemaxvalue", 1<<20, "Largest value (bytes) the memcached front-end accepts; same as memcached's -I")
+	HTTPAddr          = flag.String("httpaddr", "", "Optional listen address for the HTTP/JSON gateway, fmt: [host]:port, or unix:{path}")
+	GrpcAddr          = flag.String("grpcaddr", ":8080", "Listen address for the gRPC API, fmt: [host]:port, or unix:{path} for a Unix socket")
+	TLSCert           = flag.String("tlscert", "", "PEM certificate file; if set (with -tlskey), both listeners use TLS")
+	TLSKey            = flag.String("tlskey", "", "PEM private key file for -tlscert")
+	TLSClientCA       = flag.String("tlsclientca", "", "PEM CA bundle; if set, clients must present a certificate signed by it (mutual TLS)")
+	TLSReload         = flag.Duration("tlsreload", time.Minute, "How often to check the TLS files for changes")
 )
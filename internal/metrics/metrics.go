@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	mtx      sync.Mutex
+	counters = map[string]*atomic.Int64{}
+)
+
+// Counter returns the named counter, creating it on first use. Callers
+// usually keep the returned pointer in a package-level var.
+func Counter(name string) *atomic.Int64 {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if _, ok := counters[name]; !ok {
+		counters[name] = &atomic.Int64{}
+	}
+
+	return counters[name]
+}
+
+// Names returns all registered counter names, sorted.
+func Names() []string {
+	mtx.Lock()
+	defer mtx.Unlock()
+	names := []string{}
+	for k := range counters {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Snapshot returns the current values of all counters.
+func Snapshot() map[string]int64 {
+	mtx.Lock()
+	defer mtx.Unlock()
+	m := make(map[string]int64)
+	for k, v := range counters {
+		m[k] = v.Load()
+	}
+
+	return m
+}
+
+// Reset zeroes all counters, i.e. for CONFIG RESETSTAT.
+func Reset() {
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, v := range counters {
+		v.Store(0)
+	}
+}
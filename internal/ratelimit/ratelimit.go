@@ -1,6 +1,36 @@
 package ratelimit
 
+import (
+	"golang.org/x/time/rate"
+)
+
+// Shared by all Limiter instances. Unlimited until Set is called.
+var limiter = rate.NewLimiter(rate.Inf, 0)
+
 type Limiter struct{}
 
-// TODO: Implement a proper rate limiter.
-func (*Limiter) Limit() bool { return false }
+// Limit returns true if the request should be rejected.
+func (*Limiter) Limit() bool { return !limiter.Allow() }
+
+// Set updates the allowed requests per second and burst size. Can be called
+// at runtime; a perSec <= 0 disables limiting.
+func Set(perSec float64, burst int) {
+	switch {
+	case perSec <= 0:
+		limiter.SetLimit(rate.Inf)
+	default:
+		limiter.SetLimit(rate.Limit(perSec))
+	}
+
+	limiter.SetBurst(burst)
+}
+
+// Get returns the current requests per second (0 if unlimited) and burst size.
+func Get() (float64, int) {
+	l := limiter.Limit()
+	if l == rate.Inf {
+		return 0, limiter.Burst()
+	}
+
+	return float64(l), limiter.Burst()
+}
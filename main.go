@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -14,6 +17,7 @@ import (
 
 	"cloud.google.com/go/spanner"
 	"github.com/alphauslabs/jupiter/internal/appdata"
+	"github.com/alphauslabs/jupiter/internal/certs"
 	"github.com/alphauslabs/jupiter/internal/cluster"
 	"github.com/alphauslabs/jupiter/internal/flags"
 	rl "github.com/alphauslabs/jupiter/internal/ratelimit"
@@ -24,6 +28,7 @@ import (
 	"github.com/grpc-ecosystem/go-grpc-middleware/ratelimit"
 	"github.com/tidwall/redcon"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
@@ -34,24 +39,48 @@ var (
 	// f *os.File
 )
 
-func grpcServe(ctx context.Context, network, port string, done chan error) error {
-	l, err := net.Listen(network, ":"+port)
+// listen opens a listener for addr, fmt: [host]:port, or unix:{path} for a Unix
+// domain socket. If tc is not nil, the listener is wrapped with TLS.
+func listen(addr string, tc *tls.Config) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network = "unix"
+		addr = strings.TrimPrefix(addr, "unix:")
+		os.Remove(addr) // stale socket from a previous run
+	}
+
+	l, err := net.Listen(network, addr)
 	if err != nil {
-		glog.Errorf("net.Listen failed: %v", err)
-		return err
+		return nil, err
+	}
+
+	if tc != nil {
+		l = tls.NewListener(l, tc)
 	}
 
+	return l, nil
+}
+
+// grpcServe serves our gRPC API on l, with TLS if tc is not nil. TLS is done
+// by gRPC, not by the listener, for its ALPN ("h2"), which gRPC clients require.
+func grpcServe(ctx context.Context, l net.Listener, tc *tls.Config, svc *service, done chan error) error {
 	defer l.Close()
-	gs := grpc.NewServer(
+	opts := []grpc.ServerOption{}
+	if tc != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tc)))
+	}
+
+	gs := grpc.NewServer(append(opts,
 		grpc.ChainUnaryInterceptor(
 			ratelimit.UnaryServerInterceptor(&rl.Limiter{}),
+			clientUnary,
 		),
 		grpc.ChainStreamInterceptor(
 			ratelimit.StreamServerInterceptor(&rl.Limiter{}),
+			clientStream,
 		),
-	)
+	)...)
 
-	svc := &service{}
 	v1.RegisterJupiterServer(gs, svc)
 
 	go func() {
@@ -73,6 +102,33 @@ func main() {
 		return
 	}
 
+	switch *flags.ChunkLayout {
+	case cluster.LayoutHashed, cluster.LayoutSpread:
+	default:
+		glog.Fatalf("invalid -chunklayout: %v", *flags.ChunkLayout)
+	}
+
+	if *flags.MinRunners < 1 || *flags.MinRunners > *flags.MaxActive {
+		glog.Fatalf("invalid -minrunners: should be 1 to -maxactive (%v)", *flags.MaxActive)
+	}
+
+	if err := setCompress(*flags.Compress); err != nil {
+		glog.Fatal(err)
+	}
+
+	if err := setCoalesce(*flags.Coalesce); err != nil {
+		glog.Fatal(err)
+	}
+
+	setNearCache(*flags.NearCache)
+
+	if !validRate(*flags.RateLimit) {
+		glog.Fatalf("invalid -ratelimit: %v", *flags.RateLimit)
+	}
+
+	rl.Set(*flags.RateLimit, *flags.RateBurst)
+	cluster.SetCmdTimeout(*flags.CmdTimeout)
+	cluster.SetEnqueueTimeout(*flags.EnqueueTimeout)
 	app := &appdata.AppData{}
 	var err error
 	ctx, cancel := context.WithCancel(context.Background())
@@ -134,6 +190,19 @@ func main() {
 		rcluster.AddMember(m)
 	}
 
+	if *flags.Replicas != "" {
+		for _, r := range strings.Split(*flags.Replicas, ",") {
+			primary, replica, ok := strings.Cut(r, "=")
+			if !ok {
+				glog.Fatalf("invalid -replicas entry: %v", r)
+			}
+
+			if err := rcluster.AddReplica(primary, replica); err != nil {
+				glog.Fatal(err)
+			}
+		}
+	}
+
 	// Test random ping.
 	err = rcluster.RandomPing()
 	if err != nil {
@@ -143,32 +212,94 @@ func main() {
 	clusterData.Cluster = rcluster
 	atomic.StoreInt32(&clusterData.ClusterOk, 1)
 
-	// Setup our gRPC management API.
+	// Optional TLS (and mTLS) for both our listeners.
+	var tc, peerTLS *tls.Config
+	if *flags.TLSCert != "" {
+		cr, err := certs.NewReloader(*flags.TLSCert, *flags.TLSKey, *flags.TLSClientCA)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		go cr.Run(ctx, *flags.TLSReload)
+		tc = cr.Config()
+		peerTLS = cr.PeerConfig() // our cert is also our client cert for peers
+	}
+
+	rproxy := newProxy(app, rcluster)
+	rproxy.peerTLS = peerTLS
+	if len(nearPrefixes) > 0 {
+		go rproxy.nearInvalidator(ctx)
+	}
+
+	// Setup our gRPC API.
+	gln, err := listen(*flags.GrpcAddr, nil) // TLS by grpcServe
+	if err != nil {
+		glog.Fatal(err)
+	}
+
 	go func() {
-		port := "8080"
-		glog.Infof("serving grpc at :%v", port)
-		if err := grpcServe(ctx, "tcp", port, done); err != nil {
+		glog.Infof("serving grpc at %v, tls=%v", *flags.GrpcAddr, tc != nil)
+		if err := grpcServe(ctx, gln, tc, &service{p: rproxy}, done); err != nil {
 			glog.Fatal(err)
 		}
 	}()
 
 	// Setup our Redis proxy.
-	addr := ":6379"
-	rclone := redcon.NewServer(addr, newProxy(app, rcluster).Handler,
-		func(conn redcon.Conn) bool { return true },
-		func(conn redcon.Conn, err error) {},
+	rln, err := listen(*flags.RedisAddr, tc)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	rclone := redcon.NewServer(*flags.RedisAddr, rproxy.Handler,
+		rproxy.Accept,
+		rproxy.Closed,
 	)
 
 	defer rclone.Close()
 
 	go func() {
-		glog.Infof("start redis proxy at %s", addr)
-		err := rclone.ListenAndServe()
+		glog.Infof("start redis proxy at %v, tls=%v", *flags.RedisAddr, tc != nil)
+		err := rclone.Serve(rln)
 		if err != nil {
 			glog.Fatal(err)
 		}
 	}()
 
+	// Optional memcached front-end, same data.
+	if *flags.MemcacheAddr != "" {
+		mln, err := listen(*flags.MemcacheAddr, tc)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		defer mln.Close()
+		go func() {
+			glog.Infof("start memcache front-end at %v, tls=%v", *flags.MemcacheAddr, tc != nil)
+			err := newMemcache(rproxy).Serve(mln)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				glog.Fatal(err)
+			}
+		}()
+	}
+
+	// Optional HTTP/JSON gateway.
+	if *flags.HTTPAddr != "" {
+		hln, err := listen(*flags.HTTPAddr, tc)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		hs := &http.Server{Handler: newGateway(rproxy)}
+		defer hs.Close()
+		go func() {
+			glog.Infof("start http gateway at %v, tls=%v", *flags.HTTPAddr, tc != nil)
+			err := hs.Serve(hln)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				glog.Fatal(err)
+			}
+		}()
+	}
+
 	// f, err = os.Create("/tmp/cpuprofile")
 	// if err != nil {
 	// 	log.Fatal(err)
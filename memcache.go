@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"github.com/golang/glog"
+	goredisv9 "github.com/redis/go-redis/v9"
+)
+
+const (
+	mcMaxKey      = 250               // same as memcached
+	mcMaxValue    = 512 << 20         // Redis' limit for strings
+	mcRelativeMax = 60 * 60 * 24 * 30 // exptime above this is a unix time
+	mcFlagsSuffix = "/mcflags"        // client flags are kept beside the value
+)
+
+// Scripts for the operations that need more than one Redis command. Always
+// called with KEYS = {key, key/mcflags}. TTL args are in seconds, where 0
+// means no expiry, and negative means expired.
+var (
+	// ARGV: mode (set|add|replace|cas), value, flags, ttl, cas unique (hex),
+	// auto-chunk marker. Returns the reply, then the auto-chunked value it
+	// replaced or removed, if any (see autoChunkClean).
+	mcStoreScript = `local cur = redis.call('GET', KEYS[1])
+local mode, ttl = ARGV[1], tonumber(ARGV[4])
+if mode == 'add' and cur then return {'NOT_STORED'} end
+if mode == 'replace' and not cur then return {'NOT_STORED'} end
+if mode == 'cas' then
+  if not cur then return {'NOT_FOUND'} end
+  if string.sub(redis.sha1hex(cur), 1, 15) ~= ARGV[5] then return {'EXISTS'} end
+end
+local old = false
+if cur and string.sub(cur, 1, #ARGV[6]) == ARGV[6] then old = cur end
+if ttl < 0 then
+  redis.call('DEL', KEYS[1], KEYS[2])
+  return {'STORED', old}
+end
+local function set(k, v)
+  if ttl > 0 then redis.call('SET', k, v, 'EX', ttl) else redis.call('SET', k, v) end
+end
+set(KEYS[1], ARGV[2])
+if ARGV[3] ~= '0' then set(KEYS[2], ARGV[3]) else redis.call('DEL', KEYS[2]) end
+return {'STORED', old}`
+
+	// ARGV: incr|decr, delta
+	mcIncrScript = `local cur = redis.call('GET', KEYS[1])
+if not cur then return 'NOT_FOUND' end
+if not string.match(cur, '^%d+$') then return 'NON_NUMERIC' end
+if ARGV[1] == 'incr' then return redis.call('INCRBY', KEYS[1], ARGV[2]) end
+if tonumber(cur) <= tonumber(ARGV[2]) then
+  redis.call('SET', KEYS[1], '0', 'KEEPTTL')
+  return 0
+end
+return redis.call('DECRBY', KEYS[1], ARGV[2])`
+
+	// ARGV: ttl, auto-chunk marker. Returns the reply, then the auto-chunked
+	// value it removed, if any, or else the one it touched (for its chunks).
+	mcTouchScript = `if redis.call('EXISTS', KEYS[1]) == 0 then return {'NOT_FOUND'} end
+local ttl = tonumber(ARGV[1])
+if ttl < 0 then
+  local cur = redis.call('GET', KEYS[1])
+  redis.call('DEL', KEYS[1], KEYS[2])
+  if cur and string.sub(cur, 1, #ARGV[2]) == ARGV[2] then return {'TOUCHED', cur} end
+  return {'TOUCHED'}
+end
+for _, k in ipairs(KEYS) do
+  if ttl > 0 then redis.call('EXPIRE', k, ttl) else redis.call('PERSIST', k) end
+end
+if redis.pcall('GETRANGE', KEYS[1], 0, #ARGV[2] - 1) == ARGV[2] then
+  return {'TOUCHED', false, redis.call('GET', KEYS[1])}
+end
+return {'TOUCHED'}`
+
+	mcCmds = metrics.Counter("memcache_commands")
+	mcErrs = metrics.Counter("memcache_errors")
+
+	errMcFormat   = errors.New("CLIENT_ERROR bad command line format")
+	errMcData     = errors.New("CLIENT_ERROR bad data chunk")
+	errMcTooLarge = errors.New("object too large for cache")
+)
+
+// memcache serves the memcached ASCII protocol. Each operation is translated
+// to Redis commands (or scripts) sent to the owner of the key, so memcached
+// and Redis clients share the same data: values are stored the same way as
+// through the Redis proxy (-compress, -autochunk), and client flags, when not
+// zero, are stored in '{key}/mcflags'. Writes invalidate the near cache.
+//
+// CAS uniques are derived from the stored value (first 60 bits of its SHA1),
+// so they're stable across proxies without extra state.
+type memcache struct {
+	p *proxy
+}
+
+func newMemcache(p *proxy) *memcache { return &memcache{p: p} }
+
+// Serve accepts connections from l until it's closed.
+func (mc *memcache) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go mc.handle(conn)
+	}
+}
+
+func (mc *memcache) handle(conn net.Conn) {
+	ctx, cancel := context.WithCancel(cluster.WithClient(context.Background(), conn.RemoteAddr().String()))
+	defer func() {
+		cancel() // drop whatever is still queued for us
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				glog.V(2).Infof("memcache read from %v failed: %v", conn.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else {
+			mcCmds.Add(1)
+			if quit := mc.exec(ctx, r, w, fields); quit {
+				w.Flush()
+				return
+			}
+		}
+
+		// Only flush when there's no pipelined request waiting.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec runs one request. Returns true if the connection should be closed.
+func (mc *memcache) exec(ctx context.Context, r *bufio.Reader, w *bufio.Writer, fields []string) bool {
+	name := strings.ToLower(fields[0])
+	args := fields[1:]
+	noreply := false
+	switch name {
+	case "set", "add", "replace", "cas", "delete", "incr", "decr", "touch":
+		if len(args) > 0 && args[len(args)-1] == "noreply" {
+			noreply = true
+			args = args[:len(args)-1]
+		}
+	}
+
+	var reply string
+	var err error
+	switch name {
+	case "get", "gets":
+		err = mc.get(ctx, w, args, name == "gets")
+	case "set", "add", "replace", "cas":
+		reply, err = mc.store(ctx, r, name, args)
+	case "delete":
+		reply, err = mc.delete(ctx, args)
+	case "incr", "decr":
+		reply, err = mc.incr(ctx, name, args)
+	case "touch":
+		reply, err = mc.touch(ctx, args)
+	case "version":
+		reply = "VERSION jupiter"
+	case "quit":
+		return true
+	default:
+		reply = "ERROR"
+	}
+
+	if err != nil {
+		mcErrs.Add(1)
+		switch {
+		case strings.HasPrefix(err.Error(), "CLIENT_ERROR"):
+			reply = err.Error()
+		default:
+			reply = "SERVER_ERROR " + err.Error()
+		}
+
+		if errors.Is(err, errMcData) {
+			return true // can't tell where the next request starts
+		}
+	}
+
+	if reply != "" && (!noreply || err != nil) {
+		fmt.Fprintf(w, "%v\r\n", reply)
+	}
+
+	return false
+}
+
+// get handles 'get|gets {key}*'. Keys are fetched one at a time, in order,
+// and nothing is written until all of them are.
+func (mc *memcache) get(ctx context.Context, w *bufio.Writer, keys []string, cas bool) error {
+	if len(keys) == 0 {
+		return errMcFormat
+	}
+
+	for _, k := range keys {
+		if len(k) > mcMaxKey {
+			return errMcFormat
+		}
+	}
+
+	var out bytes.Buffer
+	for _, k := range keys {
+		v, err := mc.do(ctx, k, "MGET", k, k+mcFlagsSuffix)
+		if err != nil {
+			return err
+		}
+
+		l, _ := v.([]interface{})
+		if len(l) != 2 || l[0] == nil {
+			continue // miss
+		}
+
+		stored, _ := l[0].(string)
+		val, err := mc.value(ctx, k, stored)
+		if err != nil {
+			return err
+		}
+
+		cflags := "0"
+		if f, ok := l[1].(string); ok {
+			cflags = f
+		}
+
+		if cas {
+			fmt.Fprintf(&out, "VALUE %v %v %v %v\r\n", k, cflags, len(val), mcCasUnique(stored))
+		} else {
+			fmt.Fprintf(&out, "VALUE %v %v %v\r\n", k, cflags, len(val))
+		}
+
+		out.WriteString(val)
+		out.WriteString("\r\n")
+	}
+
+	out.WriteString("END\r\n")
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// store handles 'set|add|replace {key} {flags} {exptime} {bytes}' and
+// 'cas {key} {flags} {exptime} {bytes} {cas unique}', followed by the data.
+func (mc *memcache) store(ctx context.Context, r *bufio.Reader, mode string, args []string) (string, error) {
+	want := 4
+	if mode == "cas" {
+		want = 5
+	}
+
+	if len(args) != want {
+		return "", errMcFormat
+	}
+
+	key := args[0]
+	cflags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exp, err2 := strconv.ParseInt(args[2], 10, 64)
+	n, err3 := strconv.Atoi(args[3])
+	if len(key) > mcMaxKey || err1 != nil || err2 != nil || err3 != nil || n < 0 || n > mcMaxValue {
+		return "", errMcFormat
+	}
+
+	if n > *flags.MemcacheMaxValue {
+		// Skip the data, as memcached does, so the connection can be reused.
+		if _, err := io.CopyN(io.Discard, r, int64(n)+2); err != nil {
+			return "", errMcData
+		}
+
+		return "", errMcTooLarge
+	}
+
+	// Read as it arrives, instead of allocating n upfront.
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(n)+2); err != nil || !bytes.HasSuffix(data.Bytes(), []byte("\r\n")) {
+		return "", errMcData
+	}
+
+	unique := ""
+	if mode == "cas" {
+		u, err := strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			return "", errMcFormat
+		}
+
+		unique = fmt.Sprintf("%015x", u)
+	}
+
+	// Only plain sets are auto-chunked; the others have to check the current
+	// value first, and the chunks would overwrite it.
+	value := data.Bytes()[:n]
+	ttl := mcTTL(exp)
+	defer mc.wrote(key)
+	var m *distManifest
+	switch {
+	case mode == "set" && ttl >= 0 && autoChunked(n):
+		var err error
+		m, err = mc.p.distSet(ctx, key, value, time.Duration(ttl)*time.Second, *flags.ChunkSize, *flags.ChunkLayout)
+		if err != nil {
+			return "", err
+		}
+
+		b, _ := json.Marshal(m)
+		value = append([]byte(autoChunkMarker), b...)
+	default:
+		value = compressValue(key, value)
+	}
+
+	v, err := mc.eval(ctx, mcStoreScript, key, mode, value, fmt.Sprint(cflags), ttl, unique, autoChunkMarker)
+	if err != nil {
+		return "", err
+	}
+
+	reply, gone := mcReply(key, v)
+	mc.p.autoChunkClean(ctx, gone, m)
+	return reply, nil
+}
+
+// delete handles 'delete {key}'.
+func (mc *memcache) delete(ctx context.Context, args []string) (string, error) {
+	// Old clients send a time arg; memcached only accepts 0.
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+
+	if len(args) != 1 || len(args[0]) > mcMaxKey {
+		return "", errMcFormat
+	}
+
+	defer mc.wrote(args[0])
+	v, err := mc.do(ctx, args[0], "DEL", args[0], args[0]+mcFlagsSuffix)
+	if err != nil {
+		return "", err
+	}
+
+	if n, _ := v.(int64); n == 0 {
+		return "NOT_FOUND", nil
+	}
+
+	return "DELETED", nil
+}
+
+// incr handles 'incr|decr {key} {delta}'. Values are limited to int64, not
+// uint64 as in memcached.
+func (mc *memcache) incr(ctx context.Context, op string, args []string) (string, error) {
+	if len(args) != 2 || len(args[0]) > mcMaxKey {
+		return "", errMcFormat
+	}
+
+	if _, err := strconv.ParseInt(args[1], 10, 64); err != nil || strings.HasPrefix(args[1], "-") {
+		return "", errors.New("CLIENT_ERROR invalid numeric delta argument")
+	}
+
+	defer mc.wrote(args[0])
+	v, err := mc.eval(ctx, mcIncrScript, args[0], op, args[1])
+	if err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case int64:
+		return fmt.Sprint(v), nil
+	case string:
+		if v == "NON_NUMERIC" {
+			return "", errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		}
+
+		return v, nil
+	default:
+		return "", fmt.Errorf("unexpected reply type %T", v)
+	}
+}
+
+// touch handles 'touch {key} {exptime}'.
+func (mc *memcache) touch(ctx context.Context, args []string) (string, error) {
+	if len(args) != 2 || len(args[0]) > mcMaxKey {
+		return "", errMcFormat
+	}
+
+	exp, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "", errMcFormat
+	}
+
+	defer mc.wrote(args[0])
+	ttl := mcTTL(exp)
+	v, err := mc.eval(ctx, mcTouchScript, args[0], ttl, autoChunkMarker)
+	if err != nil {
+		return "", err
+	}
+
+	reply, gone := mcReply(args[0], v)
+	mc.p.autoChunkClean(ctx, gone, nil)
+	if l, _ := v.([]interface{}); len(l) > 2 {
+		if m, ok := autoChunkManifest(l[2]); ok {
+			ms := int64(-1) // none
+			if ttl > 0 {
+				ms = ttl * 1000
+			}
+
+			mc.p.autoChunkExpire(ctx, args[0], m, ms)
+		}
+	}
+
+	return reply, nil
+}
+
+// do sends a command to the owner of key, with the default deadline. Removed
+// auto-chunked values (i.e. by DEL) are cleaned up, as in the Redis proxy.
+func (mc *memcache) do(ctx context.Context, key string, args ...interface{}) (interface{}, error) {
+	ctx, cancel := cluster.WithTimeout(ctx, 0)
+	defer cancel()
+	b := [][]byte{}
+	for _, a := range args {
+		switch a := a.(type) {
+		case []byte:
+			b = append(b, a)
+		default:
+			b = append(b, []byte(fmt.Sprint(a)))
+		}
+	}
+
+	v, err := mc.p.autoChunkDo(ctx, key, b)
+	if errors.Is(err, goredisv9.Nil) {
+		return nil, nil
+	}
+
+	return v, err
+}
+
+// eval runs script with KEYS = {key, key/mcflags} on the owner of key,
+// loading it first if the member doesn't have it yet.
+func (mc *memcache) eval(ctx context.Context, script, key string, argv ...interface{}) (interface{}, error) {
+	args := []interface{}{"EVALSHA", cluster.ScriptSha1(script), 2, key, key + mcFlagsSuffix}
+	args = append(args, argv...)
+	v, err := mc.do(ctx, key, args...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		args[0], args[1] = "EVAL", script
+		v, err = mc.do(ctx, key, args...)
+	}
+
+	return v, err
+}
+
+// value returns the value stored at key as the client sees it, reassembled
+// if it's auto-chunked, and decompressed.
+func (mc *memcache) value(ctx context.Context, key, stored string) (string, error) {
+	v, err := mc.p.autoChunkValue(ctx, key, stored)
+	if err != nil {
+		return "", err
+	}
+
+	s, _ := decompressReply("GET", v).(string)
+	return s, nil
+}
+
+// wrote invalidates key in the near cache, after a write.
+func (mc *memcache) wrote(key string) { mc.p.nearWrote(mc.p.cluster.Locate(key), key) }
+
+// mcReply splits the reply of our store and touch scripts into the reply for
+// the client, and the auto-chunked value at key that was removed, if any.
+func mcReply(key string, v interface{}) (string, []autoChunkGone) {
+	l, _ := v.([]interface{})
+	if len(l) == 0 {
+		return fmt.Sprint(v), nil
+	}
+
+	var gone []autoChunkGone
+	if len(l) > 1 {
+		if m, ok := autoChunkManifest(l[1]); ok {
+			gone = append(gone, autoChunkGone{key: key, m: m})
+		}
+	}
+
+	return fmt.Sprint(l[0]), gone
+}
+
+// mcTTL converts a memcached exptime to seconds for our scripts: 0 is no
+// expiry, negative is already expired.
+func mcTTL(exp int64) int64 {
+	switch {
+	case exp == 0:
+		return 0
+	case exp < 0:
+		return -1
+	case exp > mcRelativeMax: // absolute unix time
+		ttl := exp - time.Now().Unix()
+		if ttl <= 0 {
+			return -1
+		}
+
+		return ttl
+	default:
+		return exp
+	}
+}
+
+// mcCasUnique returns the first 60 bits of v's SHA1, same as our scripts.
+func mcCasUnique(v string) uint64 {
+	h := sha1.Sum([]byte(v))
+	u, _ := strconv.ParseUint(hex.EncodeToString(h[:])[:15], 16, 64)
+	return u
+}
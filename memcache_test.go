@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMcTTL(t *testing.T) {
+	now := time.Now().Unix()
+	for _, tc := range []struct {
+		name string
+		exp  int64
+		want int64 // 0 = none, -1 = expired
+		slop int64 // for absolute times
+	}{
+		{name: "none", exp: 0, want: 0},
+		{name: "negative", exp: -1, want: -1},
+		{name: "negative, large", exp: -now, want: -1},
+		{name: "relative", exp: 1, want: 1},
+		{name: "relative, 30 days", exp: mcRelativeMax, want: mcRelativeMax},
+		{name: "absolute, past", exp: mcRelativeMax + 1, want: -1},
+		{name: "absolute, now", exp: now, want: -1},
+		{name: "absolute", exp: now + 100, want: 100, slop: 2},
+		{name: "absolute, far", exp: now + 2*mcRelativeMax, want: 2 * mcRelativeMax, slop: 2},
+	} {
+		got := mcTTL(tc.exp)
+		if got < tc.want-tc.slop || got > tc.want {
+			t.Errorf("%v: mcTTL(%v) = %v, want %v", tc.name, tc.exp, got, tc.want)
+		}
+	}
+}
+
+func TestMcCasUnique(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // the first 15 hex digits of its SHA1, as our scripts have it
+	}{
+		{"", "da39a3ee5e6b4b0"},
+		{"abc", "a9993e364706816"},
+		{"hello", "aaf4c61ddcc5e8a"},
+	} {
+		if got := fmt.Sprintf("%015x", mcCasUnique(tc.in)); got != tc.want {
+			t.Errorf("mcCasUnique(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMcReply(t *testing.T) {
+	marker := autoChunkMarker + `{"chunks":2,"size":10,"chunksize":5,"layout":"hashed","crc32c":[1,2]}`
+	for _, tc := range []struct {
+		in   interface{}
+		want string
+		gone bool
+	}{
+		{[]interface{}{"STORED"}, "STORED", false},
+		{[]interface{}{"STORED", marker}, "STORED", true},
+		{[]interface{}{"TOUCHED", marker}, "TOUCHED", true},
+		{[]interface{}{"TOUCHED", nil, marker}, "TOUCHED", false}, // kept; only its TTL changed
+		{[]interface{}{"STORED", "plain value"}, "STORED", false},
+		{[]interface{}{"NOT_STORED", nil}, "NOT_STORED", false},
+		{"DELETED", "DELETED", false},
+		{int64(1), "1", false},
+	} {
+		got, gone := mcReply("k", tc.in)
+		if got != tc.want || (len(gone) > 0) != tc.gone {
+			t.Errorf("mcReply(%q) = %q, %v, want %q, gone: %v", tc.in, got, gone, tc.want, tc.gone)
+		}
+
+		if len(gone) > 0 && (gone[0].key != "k" || gone[0].m.Chunks != 2) {
+			t.Errorf("mcReply(%q) gone = %+v", tc.in, gone[0])
+		}
+	}
+}
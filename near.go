@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal"
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/metrics"
+	"github.com/flowerinthenight/hedge"
+	"github.com/golang/glog"
+	"github.com/tidwall/redcon"
+)
+
+// nearBatch is the most invalidations we send in one broadcast.
+const nearBatch = 1_000
+
+var (
+	nearPrefixes []string // set once, in main
+
+	nearDropped = metrics.Counter("nearcache_dropped_invalidations")
+)
+
+// setNearCache parses -nearcache, fmt: {prefix}[,...].
+func setNearCache(s string) {
+	prefixes := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			prefixes = append(prefixes, v)
+		}
+	}
+
+	nearPrefixes = prefixes
+}
+
+// nearCached returns true if key's values are kept in our near cache.
+func nearCached(key string) bool {
+	for _, v := range nearPrefixes {
+		if strings.HasPrefix(key, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nearGet returns the reply of GET key in member host, from our near cache if
+// it's there, otherwise from get, which is then cached. Replies are cached as
+// they come from the member, so still compressed (if they were).
+func (p *proxy) nearGet(host, key string, get func() (interface{}, error)) (interface{}, error) {
+	if !nearCached(key) {
+		return get()
+	}
+
+	nc := p.cluster.Near
+	nkey := cluster.NearKey(host, key)
+	if v, ok := nc.Get(nkey); ok {
+		return v, nil
+	}
+
+	token := nc.Reserve(nkey)
+	v, err := get()
+	if s, ok := v.(string); ok && err == nil {
+		nc.Fill(nkey, token, s)
+	} else {
+		nc.Drop(nkey, token)
+	}
+
+	return v, err
+}
+
+// nearWrote invalidates keys, just written to member host, in our near cache,
+// then in the other proxies', with the next broadcast.
+func (p *proxy) nearWrote(host string, keys ...string) {
+	for _, k := range keys {
+		if !nearCached(k) {
+			continue
+		}
+
+		nkey := cluster.NearKey(host, k)
+		p.cluster.Near.Invalidate(nkey)
+		select {
+		case p.nearQueue <- nkey:
+		default:
+			nearDropped.Add(1) // -nearcachettl still applies
+		}
+	}
+}
+
+// nearWrites calls nearWrote for the keys written by args (sent as meta
+// says), if any; for our Handler and the gRPC Exec. FLUSHDB/FLUSHALL flush
+// all near caches.
+func (p *proxy) nearWrites(meta metaT, args [][]byte) {
+	if len(nearPrefixes) == 0 {
+		return
+	}
+
+	name := strings.ToLower(string(args[0]))
+	var keys []string
+	switch name {
+	case "flushdb", "flushall":
+		p.nearFlush()
+		return
+	case "eval", "evalsha", "fcall": // keys are declared
+		hash, err := scriptKey(p.cluster, redcon.Command{Args: args}, meta)
+		if err != nil {
+			return
+		}
+
+		n, _ := strconv.Atoi(string(args[2])) // checked by scriptKey
+		for _, k := range args[3 : 3+n] {
+			keys = append(keys, string(k))
+		}
+
+		meta.key = hash
+	default:
+		ci, ok := commandTable[name]
+		if !ok || !ci.hasFlag("write") {
+			return
+		}
+
+		keys = ci.keys(args)
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	switch {
+	case meta.member != "":
+		p.nearWrote(meta.member, keys...)
+	case meta.fanout:
+		for _, h := range p.cluster.Members() {
+			p.nearWrote(h, keys...)
+		}
+	default:
+		key := meta.key
+		if key == "" {
+			key = keys[0]
+		}
+
+		p.nearWrote(p.cluster.Locate(key), keys...)
+	}
+}
+
+// nearFlush empties our near cache, then the other proxies'.
+func (p *proxy) nearFlush() {
+	p.cluster.Near.Flush()
+	go p.nearBroadcast(cluster.NearCacheInput{Flush: true})
+}
+
+// nearInvalidator broadcasts the keys queued by nearWrote to the other
+// proxies, in batches, until ctx is done.
+func (p *proxy) nearInvalidator(ctx context.Context) {
+	tick := time.NewTicker(time.Millisecond * 10)
+	defer tick.Stop()
+	keys := []string{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case k := <-p.nearQueue:
+			if keys = append(keys, k); len(keys) < nearBatch {
+				continue
+			}
+		case <-tick.C:
+			if len(keys) == 0 {
+				continue
+			}
+		}
+
+		p.nearBroadcast(cluster.NearCacheInput{Keys: keys})
+		keys = []string{}
+	}
+}
+
+func (p *proxy) nearBroadcast(in cluster.NearCacheInput) {
+	b, _ := json.Marshal(internal.NewEvent(in, cluster.EventSource, cluster.CtrlBroadcastNearCache))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	outs := p.app.FleetOp.Broadcast(ctx, b, hedge.BroadcastArgs{SkipSelf: true})
+	for _, out := range outs {
+		if out.Error != nil {
+			glog.Errorf("near cache broadcast to %v failed: %v", out.Id, out.Error)
+		}
+	}
+}
@@ -20,6 +20,21 @@ const _ = grpc.SupportPackageIsVersion7
 type JupiterClient interface {
 	// Gets information about the cluster.
 	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	// Gets the value of a key.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Sets the value of a key, with an optional TTL.
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
+	// Deletes a key.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Gets the values of multiple keys. Each key is routed on its own (unless
+	// a hash key is set), and replies are streamed in request order.
+	MGet(ctx context.Context, in *MGetRequest, opts ...grpc.CallOption) (Jupiter_MGetClient, error)
+	// Runs any Redis command through the proxy, same as RESP clients.
+	Exec(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (*ExecResponse, error)
+	// Internal: used by proxies to read DISTGET chunks from each other. The
+	// first message is the header (sizes, missing); the rest are the chunks'
+	// data, in parts, in request order.
+	DistributedGet(ctx context.Context, in *DistributedGetRequest, opts ...grpc.CallOption) (Jupiter_DistributedGetClient, error)
 }
 
 type jupiterClient struct {
@@ -39,12 +54,127 @@ func (c *jupiterClient) Status(ctx context.Context, in *StatusRequest, opts ...g
 	return out, nil
 }
 
+func (c *jupiterClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, "/jupiter.proto.v1.Jupiter/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jupiterClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
+	err := c.cc.Invoke(ctx, "/jupiter.proto.v1.Jupiter/Set", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jupiterClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/jupiter.proto.v1.Jupiter/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jupiterClient) MGet(ctx context.Context, in *MGetRequest, opts ...grpc.CallOption) (Jupiter_MGetClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Jupiter_ServiceDesc.Streams[0], "/jupiter.proto.v1.Jupiter/MGet", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &jupiterMGetClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Jupiter_MGetClient interface {
+	Recv() (*MGetResponse, error)
+	grpc.ClientStream
+}
+
+type jupiterMGetClient struct {
+	grpc.ClientStream
+}
+
+func (x *jupiterMGetClient) Recv() (*MGetResponse, error) {
+	m := new(MGetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *jupiterClient) Exec(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (*ExecResponse, error) {
+	out := new(ExecResponse)
+	err := c.cc.Invoke(ctx, "/jupiter.proto.v1.Jupiter/Exec", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jupiterClient) DistributedGet(ctx context.Context, in *DistributedGetRequest, opts ...grpc.CallOption) (Jupiter_DistributedGetClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Jupiter_ServiceDesc.Streams[1], "/jupiter.proto.v1.Jupiter/DistributedGet", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &jupiterDistributedGetClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Jupiter_DistributedGetClient interface {
+	Recv() (*DistributedGetResponse, error)
+	grpc.ClientStream
+}
+
+type jupiterDistributedGetClient struct {
+	grpc.ClientStream
+}
+
+func (x *jupiterDistributedGetClient) Recv() (*DistributedGetResponse, error) {
+	m := new(DistributedGetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // JupiterServer is the server API for Jupiter service.
 // All implementations must embed UnimplementedJupiterServer
 // for forward compatibility
 type JupiterServer interface {
 	// Gets information about the cluster.
 	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	// Gets the value of a key.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Sets the value of a key, with an optional TTL.
+	Set(context.Context, *SetRequest) (*SetResponse, error)
+	// Deletes a key.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Gets the values of multiple keys. Each key is routed on its own (unless
+	// a hash key is set), and replies are streamed in request order.
+	MGet(*MGetRequest, Jupiter_MGetServer) error
+	// Runs any Redis command through the proxy, same as RESP clients.
+	Exec(context.Context, *ExecRequest) (*ExecResponse, error)
+	// Internal: used by proxies to read DISTGET chunks from each other. The
+	// first message is the header (sizes, missing); the rest are the chunks'
+	// data, in parts, in request order.
+	DistributedGet(*DistributedGetRequest, Jupiter_DistributedGetServer) error
 	mustEmbedUnimplementedJupiterServer()
 }
 
@@ -55,6 +185,24 @@ type UnimplementedJupiterServer struct {
 func (UnimplementedJupiterServer) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
 }
+func (UnimplementedJupiterServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedJupiterServer) Set(context.Context, *SetRequest) (*SetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+func (UnimplementedJupiterServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedJupiterServer) MGet(*MGetRequest, Jupiter_MGetServer) error {
+	return status.Errorf(codes.Unimplemented, "method MGet not implemented")
+}
+func (UnimplementedJupiterServer) Exec(context.Context, *ExecRequest) (*ExecResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Exec not implemented")
+}
+func (UnimplementedJupiterServer) DistributedGet(*DistributedGetRequest, Jupiter_DistributedGetServer) error {
+	return status.Errorf(codes.Unimplemented, "method DistributedGet not implemented")
+}
 func (UnimplementedJupiterServer) mustEmbedUnimplementedJupiterServer() {}
 
 // UnsafeJupiterServer may be embedded to opt out of forward compatibility for this service.
@@ -86,6 +234,120 @@ func _Jupiter_Status_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Jupiter_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JupiterServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/jupiter.proto.v1.Jupiter/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JupiterServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Jupiter_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JupiterServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/jupiter.proto.v1.Jupiter/Set",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JupiterServer).Set(ctx, req.(*SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Jupiter_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JupiterServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/jupiter.proto.v1.Jupiter/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JupiterServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Jupiter_MGet_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(MGetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(JupiterServer).MGet(m, &jupiterMGetServer{stream})
+}
+
+type Jupiter_MGetServer interface {
+	Send(*MGetResponse) error
+	grpc.ServerStream
+}
+
+type jupiterMGetServer struct {
+	grpc.ServerStream
+}
+
+func (x *jupiterMGetServer) Send(m *MGetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Jupiter_Exec_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExecRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JupiterServer).Exec(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/jupiter.proto.v1.Jupiter/Exec",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JupiterServer).Exec(ctx, req.(*ExecRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Jupiter_DistributedGet_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DistributedGetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(JupiterServer).DistributedGet(m, &jupiterDistributedGetServer{stream})
+}
+
+type Jupiter_DistributedGetServer interface {
+	Send(*DistributedGetResponse) error
+	grpc.ServerStream
+}
+
+type jupiterDistributedGetServer struct {
+	grpc.ServerStream
+}
+
+func (x *jupiterDistributedGetServer) Send(m *DistributedGetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Jupiter_ServiceDesc is the grpc.ServiceDesc for Jupiter service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -97,7 +359,34 @@ var Jupiter_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Status",
 			Handler:    _Jupiter_Status_Handler,
 		},
+		{
+			MethodName: "Get",
+			Handler:    _Jupiter_Get_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _Jupiter_Set_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Jupiter_Delete_Handler,
+		},
+		{
+			MethodName: "Exec",
+			Handler:    _Jupiter_Exec_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "MGet",
+			Handler:       _Jupiter_MGet_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "DistributedGet",
+			Handler:       _Jupiter_DistributedGet_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/v1/jupiter.proto",
 }
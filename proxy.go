@@ -1,268 +1,273 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
-	"time"
 
-	"github.com/alphauslabs/jupiter/internal"
 	"github.com/alphauslabs/jupiter/internal/appdata"
 	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/alphauslabs/jupiter/internal/metrics"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"github.com/tidwall/redcon"
+	"google.golang.org/grpc"
 )
 
 var (
-	mu    sync.RWMutex
-	items = make(map[string][]byte)
-	ps    redcon.PubSub
-
 	cmds = map[string]func(redcon.Conn, redcon.Command, metaT){
-		"ping":    pingCmd,
-		"distget": distGetCmd,
-		"detach":  detachCmd,
-		"quit":    quitCmd,
-		"config":  configCmd,
+		"ping":         pingCmd,
+		"distget":      distGetCmd,
+		"distgetrange": distGetRangeCmd,
+		"distset":      distSetCmd,
+		"distdel":      distDelCmd,
+		"distexpire":   distExpireCmd,
+		"distttl":      distTTLCmd,
+		"distexists":   distExistsCmd,
+		"detach":       detachCmd,
+		"quit":         quitCmd,
+		"config":       configCmd,
+		"info":         infoCmd,
+		"command":      commandCmd,
+
+		"eval":       evalCmd,
+		"eval_ro":    evalCmd,
+		"evalsha":    evalCmd,
+		"evalsha_ro": evalCmd,
+		"fcall":      evalCmd,
+		"fcall_ro":   evalCmd,
+		"script":     scriptCmd,
+		"function":   functionCmd,
+
+		"cluster":   clusterCmd,
+		"readonly":  okCmd,
+		"readwrite": okCmd,
+		"asking":    okCmd,
+
+		"jupiter.route": routeCmd,
 	}
+
+	proxiedCmds = metrics.Counter("proxied_commands")
+	proxiedErrs = metrics.Counter("proxied_errors")
 )
 
 type metaT struct {
-	this   *proxy // required
-	key    string // optional
-	chunks int    // optional, used in DISTGET
+	this      *proxy          // required
+	ctx       context.Context // connection's context
+	key       string          // optional, resolved hash key
+	directive                 // optional, from the last arg
+}
+
+// context returns the context for one command: the connection's, with either
+// the timeout= directive or the default (-cmdtimeout) as deadline.
+func (m metaT) context() (context.Context, context.CancelFunc) {
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return cluster.WithTimeout(ctx, m.timeout)
 }
 
 type proxy struct {
 	app     *appdata.AppData
 	cluster *cluster.Cluster
+
+	peerTLS *tls.Config // for dialing other proxies, nil for plaintext
+	peerMtx sync.Mutex
+	peers   map[string]*grpc.ClientConn // key: gRPC host:port
+
+	nearQueue chan string // near cache keys to invalidate in other proxies
 }
 
-// Special: optional last args fmt: hash={key}[,len=n]|index={num}
-// where:
-//
-//	{key} = string combination (chars not allowed: ,=)
-//	n     = if provided, use as len instead of querying 'key/len'
-//	        (for now, used in DISTGET)
-//	{num} = 0-based index in args to use as hash key
+// Special: optional last arg, a routing directive (see directive.go), i.e.
+// hash={key}[,len=n], index={num}, jupiter:fanout=all, jupiter:member={host},
+// etc.
 //
-// If this custom args is not provided, args[1] will be used.
+// If this custom arg is not provided, the connection's sticky hash key (see
+// routeCmd) will be used, then args[1]. Connections in strict mode skip this
+// parsing altogether.
 func (p *proxy) Handler(conn redcon.Conn, cmd redcon.Command) {
 	ncmd := cmd
 	var key string
-	var chunks int
-	if len(ncmd.Args) >= 2 {
-		var custom bool
+	var dir directive
+	st := stateOf(conn)
+	if len(ncmd.Args) >= 2 && !st.strict {
 		last := string(ncmd.Args[len(ncmd.Args)-1])
-		switch {
-		case strings.HasPrefix(last, "hash="):
-			ll := strings.Split(last, ",")
-			if len(ll) > 1 { // see if len=n is provided
-				if strings.HasPrefix(ll[1], "len=") {
-					chunks, _ = strconv.Atoi(strings.Split(ll[1], "=")[1])
-				}
-			}
-
-			key = strings.Split(ll[0], "=")[1]
-			custom = true
-		case strings.HasPrefix(last, "index="):
-			i, err := strconv.Atoi(strings.Split(last, "=")[1])
+		if isDirective(last) {
+			var err error
+			dir, err = parseDirective(last)
 			if err != nil {
-				conn.WriteError("ERR " + err.Error())
+				conn.WriteError(err.Error())
 				return
 			}
 
-			if i == 0 || i >= (len(ncmd.Args)-1) {
-				conn.WriteError("ERR " + fmt.Sprintf("invalid index [%d]", i))
-				return
-			}
-
-			key = string(ncmd.Args[i])
-			custom = true
-		}
-
-		if custom {
 			ncmd = redcon.Command{
 				Raw:  cmd.Raw,
 				Args: cmd.Args[:len(cmd.Args)-1],
 			}
+
+			switch {
+			case dir.index > 0:
+				if dir.index >= len(ncmd.Args) {
+					conn.WriteError(fmt.Sprintf("ERR invalid index [%d]", dir.index))
+					return
+				}
+
+				key = string(ncmd.Args[dir.index])
+			case dir.hash != "":
+				key = dir.hash
+			}
 		}
 	}
 
+	if key == "" {
+		key = st.hash
+	}
+
+	meta := metaT{this: p, ctx: st.ctx, key: key, directive: dir}
+	defer func() { p.nearWrites(meta, ncmd.Args) }() // meta as resolved below
 	cmdtl := strings.ToLower(string(ncmd.Args[0]))
 	if _, found := cmds[cmdtl]; found {
-		meta := metaT{this: p, key: key, chunks: chunks}
 		cmds[cmdtl](conn, ncmd, meta)
 		return
 	}
 
-	if len(ncmd.Args) >= 2 && key == "" {
-		key = string(ncmd.Args[1])
+	if len(ncmd.Args) >= 2 && meta.key == "" {
+		meta.key = string(ncmd.Args[1])
 	}
 
-	if key == "" {
-		key = uuid.NewString()
+	if meta.key == "" {
+		meta.key = uuid.NewString()
 	}
 
-	v, err := p.cluster.Do(key, ncmd.Args)
-	if err != nil {
-		// Already have the 'ERR ' prefix.
-		conn.WriteError(err.Error())
+	if autoChunkSet(conn, ncmd, meta) {
 		return
 	}
 
-	// Write as is.
-	conn.WriteAny(v)
-}
-
-func newProxy(app *appdata.AppData, c *cluster.Cluster) *proxy {
-	return &proxy{app: app, cluster: c}
-}
-
-func pingCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	proxiedCmds.Add(1)
+	var v interface{}
+	var err error
 	switch {
-	case meta.key != "":
-		v, err := meta.this.cluster.Do(meta.key, cmd.Args)
-		if err != nil {
-			conn.WriteError("ERR " + err.Error())
-		} else {
-			conn.WriteAny(v)
+	case cmdtl == "get" && len(ncmd.Args) == 2 && !meta.fanout && !meta.replica:
+		// Not replica reads: they can lag, and we'd cache what they missed.
+		host := meta.member
+		if host == "" {
+			host = p.cluster.Locate(meta.key)
 		}
+
+		v, err = p.nearGet(host, string(ncmd.Args[1]), func() (interface{}, error) {
+			return p.do(meta, ncmd.Args)
+		})
+	case autoChunkCmds[cmdtl] && *flags.AutoChunk > 0 && meta.member == "" && !meta.fanout:
+		ctx, cancel := meta.context()
+		defer cancel()
+		var gone []autoChunkGone
+		v, gone, err = p.autoChunkExec(ctx, meta.key, compressArgs(ncmd.Args))
+		defer p.autoChunkClean(ctx, gone, nil) // after the reply; GETDEL streams it
 	default:
-		conn.WriteString("PONG")
+		v, err = p.do(meta, compressArgs(ncmd.Args))
 	}
 
-	// pprof
-	// pprof.StopCPUProfile()
-}
-
-// distGetCmd is a very naive implementation of a distributed GET. It tries to get
-// the current list of active nodes (not Redis) in the cluster, distribute the GET
-// load to all of them (including the node that received the call), and wait for
-// all responses. Trouble is, this is deployed as a Deployment in k8s, where pods
-// are quite volatile, so chances of pods not being available at call time, or
-// disappearing mid processing is quite high. Probably need to look at deploying
-// this as MIGs in GCP, that could be a slightly more stable environment for this
-// kind of load distribution. At the moment, the HPA for this deployment is set
-// with min = max, so at least the scale up/down is relatively fixed.
-func distGetCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
-	var line string
-	defer func(begin time.Time, m *string) {
-		if *m != "" {
-			glog.Infof("[distGetCmd] %v, took %v", *m, time.Since(begin))
-		}
-	}(time.Now(), &line)
-
-	if len(cmd.Args) != 2 {
-		conn.WriteError("ERR invalid args")
+	if err != nil {
+		// Already have the 'ERR ' prefix.
+		proxiedErrs.Add(1)
+		conn.WriteError(err.Error())
 		return
 	}
 
-	ctx := context.Background()
-	nkey := string(cmd.Args[1]) // 'key' arg not used here
-	chunks := meta.chunks
-	if chunks == 0 { // try getting it ourselves
-		keyLen := fmt.Sprintf("%v/len", nkey) // no hash={key} used for '/len'
-		r, err := meta.this.cluster.Do(keyLen, [][]byte{[]byte("GET"), []byte(keyLen)})
-		if err != nil {
-			conn.WriteError("ERR " + err.Error())
-			return
-		}
-
-		switch r := r.(type) {
-		case string:
-			i, err := strconv.ParseInt(r, 10, 0)
-			if err != nil {
-				conn.WriteError("ERR " + err.Error())
-				return
-			}
-			chunks = int(i)
+	if m, ok := autoChunkManifest(v); ok && (cmdtl == "get" || cmdtl == "getdel" || cmdtl == "getex") {
+		ctx, cancel := meta.context()
+		defer cancel()
+		sink := &respSink{conn: conn}
+		switch err := p.autoChunkGet(ctx, string(ncmd.Args[1]), m, sink); {
+		case err != nil && sink.started:
+			glog.Errorf("[Handler] %v %s failed mid-stream: %v", cmdtl, ncmd.Args[1], err)
+			conn.Close()
+		case err != nil:
+			conn.WriteError(err.Error())
 		default:
-			e := fmt.Errorf("unknown type %T for /len", r)
-			conn.WriteError("ERR " + e.Error())
-			return
+			conn.WriteRaw([]byte("\r\n"))
 		}
-	}
 
-	if chunks == 0 { // if still none
-		conn.WriteError("ERR no chunks found")
 		return
 	}
 
-	members := make(map[string]string)
-	for _, m := range meta.this.app.FleetOp.Members() {
-		members[m] = m
-	}
+	// Write as is, except for our compressed values.
+	conn.WriteAny(decompressReply(cmdtl, v))
+}
 
-	var nodes []string
-	for k := range members {
-		nodes = append(nodes, k)
-	}
+// do sends args to where meta says: a specific member, all members, the
+// replica of the owner of meta.key (read-only commands only), or the owner
+// itself. For fanout, the reply is a slice of replies (or errors), in member
+// order.
+func (p *proxy) do(meta metaT, args [][]byte) (interface{}, error) {
+	ctx, cancel := meta.context()
+	defer cancel()
+	switch {
+	case meta.member != "":
+		return p.cluster.DoMember(ctx, meta.member, args)
+	case meta.fanout:
+		replies, errs := p.doAll(ctx, args)
+		out := make([]interface{}, len(replies))
+		for i := range replies {
+			out[i] = replies[i]
+			if errs[i] != nil {
+				out[i] = errs[i]
+			}
+		}
 
-	// Assign query indeces to all members.
-	loc := 0
-	assign := make(map[int]string)
-	for i := 0; i < chunks; i++ {
-		assign[i] = nodes[loc]
-		loc++
-		if loc >= len(members) {
-			loc = 0
+		return out, nil
+	case meta.replica:
+		ci, ok := commandTable[strings.ToLower(string(args[0]))]
+		if ok && ci.hasFlag("readonly") {
+			return p.cluster.DoReplica(ctx, meta.key, args)
 		}
 	}
 
-	mb := make(map[int][]byte)
-	errs := []error{}
-	b, _ := json.Marshal(internal.NewEvent(
-		cluster.DistributedGetInput{Name: nkey, Assign: assign},
-		cluster.EventSource,
-		cluster.CtrlBroadcastDistributedGet,
-	))
-
-	// Send out GET assignments to all members; wait for reply.
-	// TODO: How to handle any member failing? For now, fail all.
-	outs := meta.this.app.FleetOp.Broadcast(ctx, b)
-	for _, out := range outs {
-		members[out.Id] = out.Id
-		if out.Error != nil {
-			errs = append(errs, out.Error)
-		} else {
-			var o cluster.DistributedGetOutput
-			err := json.Unmarshal(out.Reply, &o)
-			if err != nil {
-				errs = append(errs, out.Error)
-			} else {
-				for k, v := range o.Data {
-					mb[k] = v
-				}
-			}
-		}
+	return p.cluster.Do(ctx, meta.key, args)
+}
+
+// Accept sets up the state for new connections.
+func (p *proxy) Accept(conn redcon.Conn) bool {
+	conn.SetContext(newConnState(conn))
+	return true
+}
+
+// Closed cancels everything still in flight for conn.
+func (p *proxy) Closed(conn redcon.Conn, err error) {
+	if st, ok := conn.Context().(*connState); ok {
+		st.cancel()
 	}
+}
 
-	if len(errs) > 0 {
-		conn.WriteError("ERR incomplete cache data")
-		return
+func newProxy(app *appdata.AppData, c *cluster.Cluster) *proxy {
+	return &proxy{
+		app:       app,
+		cluster:   c,
+		peers:     map[string]*grpc.ClientConn{},
+		nearQueue: make(chan string, 10_000),
 	}
+}
 
-	var out bytes.Buffer
-	for i := 0; i < chunks; i++ {
-		if _, ok := mb[i]; !ok {
-			m := fmt.Sprintf("index [%v] not found", i)
-			conn.WriteError("ERR " + m)
-			return
+func pingCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	switch {
+	case meta.key != "" || meta.member != "" || meta.fanout:
+		v, err := meta.this.do(meta, cmd.Args)
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+		} else {
+			conn.WriteAny(v)
 		}
-
-		out.Write(mb[i])
+	default:
+		conn.WriteString("PONG")
 	}
 
-	line = fmt.Sprintf("key=%v, chunks=%v, len=%v, cap=%v",
-		nkey, chunks, out.Len(), out.Cap())
-
-	conn.WriteAny(out.Bytes())
+	// pprof
+	// pprof.StopCPUProfile()
 }
 
 func detachCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
@@ -280,10 +285,20 @@ func quitCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
 	conn.Close()
 }
 
-func configCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
-	// This simple (blank) response is only here to allow for the
-	// redis-benchmark command to work with this clone.
-	conn.WriteArray(2)
-	conn.WriteBulk(cmd.Args[2])
-	conn.WriteBulkString("")
+// infoCmd answers 'INFO jupiter' with our own counters; everything else goes
+// to a member as usual.
+func infoCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) == 2 && strings.EqualFold(string(cmd.Args[1]), "jupiter") {
+		var b strings.Builder
+		b.WriteString("# Jupiter\r\n")
+		snap := metrics.Snapshot()
+		for _, k := range metrics.Names() {
+			fmt.Fprintf(&b, "%v:%v\r\n", k, snap[k])
+		}
+
+		conn.WriteBulkString(b.String())
+		return
+	}
+
+	passthrough(conn, cmd, meta)
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/alphauslabs/jupiter/internal/flags"
+	"github.com/tidwall/redcon"
+)
+
+// connState is per-connection state, kept in the redcon.Conn's context.
+type connState struct {
+	hash   string // sticky hash key, set by JUPITER.ROUTE HASH
+	strict bool   // if true, trailing directives are not parsed
+
+	// Parent of all command contexts in this connection; cancelled when the
+	// connection closes so we don't keep working for a client that's gone.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConnState(conn redcon.Conn) *connState {
+	ctx, cancel := context.WithCancel(cluster.WithClient(context.Background(), conn.RemoteAddr()))
+	return &connState{strict: *flags.StrictRoute, ctx: ctx, cancel: cancel}
+}
+
+// stateOf returns conn's state, creating it if needed (i.e. conns that were
+// not accepted through our Accept).
+func stateOf(conn redcon.Conn) *connState {
+	if st, ok := conn.Context().(*connState); ok {
+		return st
+	}
+
+	st := newConnState(conn)
+	conn.SetContext(st)
+	return st
+}
+
+// routeCmd handles our per-connection routing directives:
+//
+//	JUPITER.ROUTE HASH {key}     - use {key} as hash key for all succeeding commands
+//	JUPITER.ROUTE CLEAR          - remove the sticky hash key
+//	JUPITER.ROUTE STRICT ON|OFF  - disable/enable parsing of trailing directives
+//	JUPITER.ROUTE INFO           - return the connection's current settings
+//
+// A trailing hash= directive (when not strict) still takes precedence over the
+// sticky hash key.
+func routeCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'jupiter.route' command")
+		return
+	}
+
+	st := stateOf(conn)
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch {
+	case sub == "hash" && len(cmd.Args) == 3:
+		st.hash = string(cmd.Args[2])
+		conn.WriteString("OK")
+	case sub == "clear" && len(cmd.Args) == 2:
+		st.hash = ""
+		conn.WriteString("OK")
+	case sub == "strict" && len(cmd.Args) == 3:
+		switch strings.ToLower(string(cmd.Args[2])) {
+		case "on":
+			st.strict = true
+		case "off":
+			st.strict = false
+		default:
+			conn.WriteError("ERR syntax error, expected ON or OFF")
+			return
+		}
+
+		conn.WriteString("OK")
+	case sub == "info" && len(cmd.Args) == 2:
+		strict := "off"
+		if st.strict {
+			strict = "on"
+		}
+
+		conn.WriteArray(4)
+		conn.WriteBulkString("hash")
+		conn.WriteBulkString(st.hash)
+		conn.WriteBulkString("strict")
+		conn.WriteBulkString(strict)
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", cmd.Args[1]))
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alphauslabs/jupiter/internal"
+	"github.com/alphauslabs/jupiter/internal/cluster"
+	"github.com/flowerinthenight/hedge"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/tidwall/redcon"
+)
+
+// scriptKey returns the hash key for EVAL, EVALSHA, FCALL and their _RO
+// variants, fmt: {cmd} {script|sha1|function} {numkeys} [key ...] [arg ...].
+// All declared keys must belong to the same member, unless a hash key is
+// provided, in which case it's used as is.
+func scriptKey(c *cluster.Cluster, cmd redcon.Command, meta metaT) (string, error) {
+	if len(cmd.Args) < 3 {
+		return "", fmt.Errorf("ERR wrong number of arguments for '%s' command",
+			strings.ToLower(string(cmd.Args[0])))
+	}
+
+	n, err := strconv.Atoi(string(cmd.Args[2]))
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("ERR value is not an integer or out of range")
+	case n < 0:
+		return "", fmt.Errorf("ERR Number of keys can't be negative")
+	case n > len(cmd.Args)-3:
+		return "", fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+
+	if meta.key != "" {
+		return meta.key, nil
+	}
+
+	if n == 0 {
+		return uuid.NewString(), nil
+	}
+
+	key := string(cmd.Args[3])
+	owner := c.Locate(key)
+	for _, k := range cmd.Args[4 : 3+n] {
+		if c.Locate(string(k)) != owner {
+			return "", fmt.Errorf("CROSSSLOT Keys in request don't hash to the same member")
+		}
+	}
+
+	return key, nil
+}
+
+// evalCmd handles EVAL, EVALSHA, FCALL and their _RO variants. If the member
+// no longer has the script or function (i.e. it restarted), we load it again
+// from our cache and retry once.
+func evalCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	p := meta.this
+	key, err := scriptKey(p.cluster, cmd, meta)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+
+	name := strings.ToLower(string(cmd.Args[0]))
+	ctx, cancel := meta.context()
+	defer cancel()
+	host := p.cluster.Locate(key)
+	v, err := p.cluster.DoMember(ctx, host, cmd.Args)
+	if err != nil && p.reloadScripts(ctx, host, name, cmd, err) {
+		v, err = p.cluster.DoMember(ctx, host, cmd.Args)
+	}
+
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+
+	conn.WriteAny(v)
+}
+
+// reloadScripts loads the missing script, or all known function libraries,
+// into host if err says it's missing them. Returns true if a retry makes sense.
+func (p *proxy) reloadScripts(ctx context.Context, host, name string, cmd redcon.Command, err error) bool {
+	switch name {
+	case "evalsha", "evalsha_ro":
+		if !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			return false
+		}
+
+		sha := string(cmd.Args[1])
+		body, ok := p.scriptBody(ctx, cluster.ScriptKindLua, sha)
+		if !ok {
+			return false
+		}
+
+		_, err := p.cluster.DoMember(ctx, host, [][]byte{[]byte("SCRIPT"), []byte("LOAD"), []byte(body)})
+		if err != nil {
+			glog.Errorf("reload script %v to %v failed: %v", sha, host, err)
+			return false
+		}
+
+		glog.Infof("reloaded script %v to %v", sha, host)
+		return true
+	case "fcall", "fcall_ro":
+		if !strings.Contains(err.Error(), "Function not found") {
+			return false
+		}
+
+		var n int
+		for lib, code := range p.cluster.Scripts.Libs() {
+			args := [][]byte{[]byte("FUNCTION"), []byte("LOAD"), []byte("REPLACE"), []byte(code)}
+			_, err := p.cluster.DoMember(ctx, host, args)
+			if err != nil {
+				glog.Errorf("reload library %v to %v failed: %v", lib, host, err)
+				continue
+			}
+
+			n++
+		}
+
+		glog.Infof("reloaded %v libraries to %v", n, host)
+		return n > 0
+	}
+
+	return false
+}
+
+// scriptBody looks for a script/library in our cache, then asks the other
+// proxies if we don't have it (i.e. we started after it was loaded).
+func (p *proxy) scriptBody(ctx context.Context, kind, name string) (string, bool) {
+	if v, ok := p.cluster.Scripts.Get(kind, name); ok {
+		return v, true
+	}
+
+	b, _ := json.Marshal(internal.NewEvent(
+		cluster.ScriptCacheInput{Op: cluster.ScriptOpGet, Kind: kind, Name: name},
+		cluster.EventSource,
+		cluster.CtrlBroadcastScriptCache,
+	))
+
+	outs := p.app.FleetOp.Broadcast(ctx, b, hedge.BroadcastArgs{SkipSelf: true})
+	for _, out := range outs {
+		if out.Error == nil && len(out.Reply) > 0 {
+			p.cluster.Scripts.Put(kind, name, string(out.Reply))
+			return string(out.Reply), true
+		}
+	}
+
+	return "", false
+}
+
+// shareScript updates our script cache, then the other proxies', within the
+// command's ctx; proxies that miss it will ask for the body when needed.
+func (p *proxy) shareScript(ctx context.Context, in cluster.ScriptCacheInput) {
+	switch in.Op {
+	case cluster.ScriptOpLoad:
+		p.cluster.Scripts.Put(in.Kind, in.Name, in.Body)
+	case cluster.ScriptOpDelete:
+		p.cluster.Scripts.Delete(in.Kind, in.Name)
+	case cluster.ScriptOpFlush:
+		p.cluster.Scripts.Flush(in.Kind)
+	}
+
+	b, _ := json.Marshal(internal.NewEvent(in, cluster.EventSource, cluster.CtrlBroadcastScriptCache))
+	outs := p.app.FleetOp.Broadcast(ctx, b, hedge.BroadcastArgs{SkipSelf: true})
+	for _, out := range outs {
+		if out.Error != nil {
+			glog.Errorf("script cache broadcast to %v failed: %v", out.Id, out.Error)
+		}
+	}
+}
+
+// doAll sends args to all members in parallel. Replies and errors are in the
+// same order as Cluster.Members().
+func (p *proxy) doAll(ctx context.Context, args [][]byte) ([]interface{}, []error) {
+	hosts := p.cluster.Members()
+	replies := make([]interface{}, len(hosts))
+	errs := make([]error, len(hosts))
+	var w sync.WaitGroup
+	for i, h := range hosts {
+		w.Add(1)
+		go func(i int, h string) {
+			defer w.Done()
+			replies[i], errs[i] = p.cluster.DoMember(ctx, h, args)
+		}(i, h)
+	}
+
+	w.Wait()
+	return replies, errs
+}
+
+func firstErr(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// anyOk returns nil if at least one member succeeded.
+func anyOk(errs []error) error {
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+
+	return firstErr(errs)
+}
+
+// scriptCmd handles SCRIPT subcommands. LOAD and FLUSH go to all members so
+// EVALSHA works wherever the keys land.
+func scriptCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'script' command")
+		return
+	}
+
+	p := meta.this
+	ctx, cancel := meta.context()
+	defer cancel()
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "load":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'script|load' command")
+			return
+		}
+
+		replies, errs := p.doAll(ctx, cmd.Args)
+		if err := firstErr(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		body := string(cmd.Args[2])
+		p.shareScript(ctx, cluster.ScriptCacheInput{
+			Op:   cluster.ScriptOpLoad,
+			Kind: cluster.ScriptKindLua,
+			Name: cluster.ScriptSha1(body),
+			Body: body,
+		})
+
+		conn.WriteAny(replies[0])
+	case "exists":
+		// Only exists if all members have it.
+		replies, errs := p.doAll(ctx, cmd.Args)
+		if err := firstErr(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		out := make([]int, len(cmd.Args)-2)
+		for i := range out {
+			out[i] = 1
+		}
+
+		for _, r := range replies {
+			l, _ := r.([]interface{})
+			for i := range out {
+				if i >= len(l) || fmt.Sprint(l[i]) != "1" {
+					out[i] = 0
+				}
+			}
+		}
+
+		conn.WriteArray(len(out))
+		for _, v := range out {
+			conn.WriteInt(v)
+		}
+	case "flush":
+		_, errs := p.doAll(ctx, cmd.Args)
+		p.shareScript(ctx, cluster.ScriptCacheInput{Op: cluster.ScriptOpFlush, Kind: cluster.ScriptKindLua})
+		if err := firstErr(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
+	case "kill":
+		_, errs := p.doAll(ctx, cmd.Args)
+		if err := anyOk(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
+	default:
+		passthrough(conn, cmd, meta)
+	}
+}
+
+// functionCmd handles FUNCTION subcommands, following the same model as
+// scriptCmd: changes go to all members and to our cache.
+func functionCmd(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'function' command")
+		return
+	}
+
+	p := meta.this
+	ctx, cancel := meta.context()
+	defer cancel()
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "load":
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for 'function|load' command")
+			return
+		}
+
+		replies, errs := p.doAll(ctx, cmd.Args)
+		if err := firstErr(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		lib := fmt.Sprint(replies[0]) // reply is the library name
+		p.shareScript(ctx, cluster.ScriptCacheInput{
+			Op:   cluster.ScriptOpLoad,
+			Kind: cluster.ScriptKindFunction,
+			Name: lib,
+			Body: string(cmd.Args[len(cmd.Args)-1]),
+		})
+
+		conn.WriteAny(replies[0])
+	case "delete":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'function|delete' command")
+			return
+		}
+
+		// Members that restarted won't have it; that's fine.
+		_, errs := p.doAll(ctx, cmd.Args)
+		p.shareScript(ctx, cluster.ScriptCacheInput{
+			Op:   cluster.ScriptOpDelete,
+			Kind: cluster.ScriptKindFunction,
+			Name: string(cmd.Args[2]),
+		})
+
+		if err := anyOk(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
+	case "flush":
+		_, errs := p.doAll(ctx, cmd.Args)
+		p.shareScript(ctx, cluster.ScriptCacheInput{Op: cluster.ScriptOpFlush, Kind: cluster.ScriptKindFunction})
+		if err := firstErr(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
+	case "restore":
+		// NOTE: Restored libraries are not added to our cache.
+		_, errs := p.doAll(ctx, cmd.Args)
+		if err := firstErr(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
+	case "kill":
+		_, errs := p.doAll(ctx, cmd.Args)
+		if err := anyOk(errs); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
+	default: // LIST, STATS, DUMP, etc.
+		passthrough(conn, cmd, meta)
+	}
+}
+
+// passthrough sends cmd to the member that owns the hash key, or a random
+// member if none is provided. Other routing directives are honored.
+func passthrough(conn redcon.Conn, cmd redcon.Command, meta metaT) {
+	if meta.key == "" {
+		meta.key = uuid.NewString()
+	}
+
+	v, err := meta.this.do(meta, cmd.Args)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+
+	conn.WriteAny(v)
+}
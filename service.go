@@ -1,9 +1,518 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alphauslabs/jupiter/internal/cluster"
 	v1 "github.com/alphauslabs/jupiter/proto/v1"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	goredisv9 "github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
+// mdHashKey is the gRPC metadata for the hash key, if not in the request.
+const mdHashKey = "jupiter-hash"
+
 type service struct {
 	v1.UnimplementedJupiterServer
+
+	p *proxy
+}
+
+func (s *service) Get(ctx context.Context, req *v1.GetRequest) (*v1.GetResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+
+	hash := hashKey(ctx, req.HashKey, req.Key)
+	v, err := s.p.nearGet(s.p.cluster.Locate(hash), req.Key, func() (interface{}, error) {
+		ctx, cancel := cluster.WithTimeout(ctx, 0)
+		defer cancel()
+		return s.p.cluster.Do(ctx, hash, [][]byte{[]byte("GET"), []byte(req.Key)})
+	})
+
+	v = decompressReply("GET", v)
+	switch {
+	case errors.Is(err, goredisv9.Nil):
+		return &v1.GetResponse{}, nil
+	case err != nil:
+		return nil, rpcError(err)
+	}
+
+	if v, err = s.value(ctx, req.Key, v); err != nil {
+		return nil, rpcError(err)
+	}
+
+	b, _ := v.(string)
+	return &v1.GetResponse{Value: []byte(b), Found: true}, nil
+}
+
+func (s *service) Set(ctx context.Context, req *v1.SetRequest) (*v1.SetResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+
+	hash := hashKey(ctx, req.HashKey, req.Key)
+	defer s.p.nearWrote(s.p.cluster.Locate(hash), req.Key)
+	var ttl time.Duration
+	args := [][]byte{[]byte(req.Key), req.Value}
+	if req.Ttl != nil {
+		ttl = req.Ttl.AsDuration()
+		if ttl < time.Millisecond { // PX's unit
+			return nil, status.Error(codes.InvalidArgument, "ttl should be at least 1ms")
+		}
+
+		args = append(args, []byte("PX"), []byte(fmt.Sprint(ttl.Milliseconds())))
+	}
+
+	if autoChunked(len(req.Value)) {
+		ctx, cancel := cluster.WithTimeout(ctx, 0)
+		defer cancel()
+		if err := s.p.autoChunkPut(ctx, req.Key, hash, req.Value, ttl, ""); err != nil {
+			return nil, rpcError(err)
+		}
+
+		return &v1.SetResponse{}, nil
+	}
+
+	_, err := s.do(ctx, hash, "SET", args...)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return &v1.SetResponse{}, nil
+}
+
+func (s *service) Delete(ctx context.Context, req *v1.DeleteRequest) (*v1.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+
+	hash := hashKey(ctx, req.HashKey, req.Key)
+	defer s.p.nearWrote(s.p.cluster.Locate(hash), req.Key)
+	v, err := s.do(ctx, hash, "DEL", []byte(req.Key))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	n, _ := v.(int64)
+	return &v1.DeleteResponse{Deleted: n > 0}, nil
+}
+
+func (s *service) MGet(req *v1.MGetRequest, stream v1.Jupiter_MGetServer) error {
+	ctx := stream.Context()
+	send := func(key string, v interface{}) error {
+		b, ok := v.(string)
+		return stream.Send(&v1.MGetResponse{Key: key, Value: []byte(b), Found: ok})
+	}
+
+	// All keys in the same member: one MGET.
+	if hash := hashKey(ctx, req.HashKey, ""); hash != "" && len(req.Keys) > 0 {
+		args := [][]byte{}
+		for _, k := range req.Keys {
+			args = append(args, []byte(k))
+		}
+
+		v, err := s.do(ctx, hash, "MGET", args...)
+		if err != nil {
+			return rpcError(err)
+		}
+
+		l, _ := v.([]interface{})
+		for i, k := range req.Keys {
+			var v interface{}
+			if i < len(l) {
+				v = l[i]
+			}
+
+			if v, err = s.value(ctx, k, v); err != nil {
+				return rpcError(err)
+			}
+
+			if err := send(k, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Otherwise, in parallel, up to gatewayParallel at a time (same as the
+	// gateway's batches), but still sent in order.
+	type result struct {
+		v   interface{}
+		err error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]chan result, len(req.Keys))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	sem := make(chan struct{}, gatewayParallel)
+	go func() {
+		for i, k := range req.Keys {
+			select {
+			case sem <- struct{}{}: // released as it's sent
+			case <-ctx.Done():
+				return
+			}
+
+			go func(ch chan result, k string) {
+				v, err := s.do(ctx, k, "GET", []byte(k))
+				if err == nil {
+					v, err = s.value(ctx, k, v)
+				}
+
+				ch <- result{v, err}
+			}(results[i], k)
+		}
+	}()
+
+	for i, k := range req.Keys {
+		r := <-results[i]
+		<-sem
+		switch {
+		case errors.Is(r.err, goredisv9.Nil):
+		case r.err != nil:
+			return rpcError(r.err)
+		}
+
+		if err := send(k, r.v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// value returns v, the stored value of key, as clients see it: reassembled,
+// if it's auto-chunked.
+func (s *service) value(ctx context.Context, key string, v interface{}) (interface{}, error) {
+	if _, ok := autoChunkManifest(v); !ok {
+		return v, nil
+	}
+
+	ctx, cancel := cluster.WithTimeout(ctx, 0)
+	defer cancel()
+	return s.p.autoChunkValue(ctx, key, v)
+}
+
+// Exec runs req as if it came from a RESP client, through our Handler.
+func (s *service) Exec(ctx context.Context, req *v1.ExecRequest) (*v1.ExecResponse, error) {
+	name := strings.ToLower(req.Command)
+	switch name {
+	case "":
+		return nil, status.Error(codes.InvalidArgument, "command is required")
+	case "detach", "quit", "jupiter.route": // connection commands
+		return nil, status.Errorf(codes.InvalidArgument, "%v is not supported in Exec", req.Command)
+	}
+
+	// Same as a RESP client, in strict mode: we have hash_key for routing.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn := &execConn{}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		conn.addr = p.Addr.String()
+	}
+
+	conn.SetContext(&connState{
+		hash:   hashKey(ctx, req.HashKey, ""),
+		strict: true,
+		ctx:    ctx,
+		cancel: cancel,
+	})
+
+	s.p.Handler(conn, redcon.Command{Args: append([][]byte{[]byte(req.Command)}, req.Args...)})
+	v, ok := conn.reply()
+	rerr := v.GetError()
+	switch {
+	case !ok || conn.closed:
+		return nil, status.Error(codes.Aborted, "reply failed mid-stream")
+	case strings.HasPrefix(rerr, cluster.ErrTimeout.Error()):
+		return nil, status.Error(codes.DeadlineExceeded, rerr)
+	case strings.HasPrefix(rerr, cluster.ErrBusy.Error()):
+		return nil, status.Error(codes.ResourceExhausted, rerr)
+	}
+
+	return &v1.ExecResponse{Reply: v}, nil
+}
+
+// DistributedGet is for other proxies only (see distGet): sends the sizes of
+// the chunks in req as the header, then reads each one, and sends its data,
+// in frames, before reading the next; so we hold one chunk at a time, and
+// gRPC's flow control holds back our reads, too. A chunk that changed size
+// since the header (i.e. a concurrent DISTSET) aborts the stream, for the
+// caller to reassign what's left.
+func (s *service) DistributedGet(req *v1.DistributedGetRequest, stream v1.Jupiter_DistributedGetServer) error {
+	if req.Name == "" {
+		return status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	ctx, cancel := cluster.WithTimeout(stream.Context(), 0)
+	defer cancel()
+	ids := []int{}
+	for _, id := range req.Ids {
+		ids = append(ids, int(id))
+	}
+
+	sizes, err := s.p.cluster.ChunkSizes(ctx, req.Name, req.Layout, ids)
+	if err != nil && len(sizes) == 0 {
+		return rpcError(err)
+	}
+
+	hdr := &v1.DistributedGetResponse{Sizes: make(map[int32]int64)}
+	for _, id := range ids {
+		size, ok := sizes[id]
+		if !ok {
+			hdr.Missing = append(hdr.Missing, int32(id))
+			continue
+		}
+
+		hdr.Sizes[int32(id)] = size
+	}
+
+	if err := stream.Send(hdr); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		size, ok := sizes[id]
+		if !ok {
+			continue
+		}
+
+		found, err := s.p.cluster.GetChunks(ctx, req.Name, req.Layout, []int{id})
+		b, ok := found[id]
+		switch {
+		case err != nil:
+			return rpcError(err)
+		case !ok || int64(len(b)) != size:
+			return status.Errorf(codes.Aborted, "chunk [%v] changed or gone after the header", id)
+		}
+
+		for off := 0; off < len(b); off += distFrame {
+			end := off + distFrame
+			if end > len(b) {
+				end = len(b)
+			}
+
+			msg := &v1.DistributedGetResponse{Id: int32(id), Offset: int64(off), Data: b[off:end]}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// do sends {cmd} {args} to the owner of key, with ctx's deadline, if any, or
+// our default. Values are (de)compressed as in the Redis API.
+func (s *service) do(ctx context.Context, key, cmd string, args ...[]byte) (interface{}, error) {
+	ctx, cancel := cluster.WithTimeout(ctx, 0)
+	defer cancel()
+	v, err := s.p.autoChunkDo(ctx, key, compressArgs(append([][]byte{[]byte(cmd)}, args...)))
+	return decompressReply(cmd, v), err
+}
+
+// hashKey returns the hash key from the request, then the metadata, then def.
+func hashKey(ctx context.Context, req, def string) string {
+	if req != "" {
+		return req
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(mdHashKey); len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
+	}
+
+	return def
+}
+
+// clientUnary and clientStream tag request contexts with the caller's
+// address, for -clientqueue. Not for other proxies' DistributedGet, as they
+// read on behalf of many clients.
+func clientUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(withPeer(ctx), req)
+}
+
+func clientStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if strings.HasSuffix(info.FullMethod, "/DistributedGet") {
+		return handler(srv, ss)
+	}
+
+	w := grpc_middleware.WrapServerStream(ss)
+	w.WrappedContext = withPeer(ss.Context())
+	return handler(srv, w)
+}
+
+func withPeer(ctx context.Context) context.Context {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return cluster.WithClient(ctx, p.Addr.String())
+	}
+
+	return ctx
+}
+
+// rpcError converts errors from Cluster.Do to gRPC errors. Errors from Redis
+// itself (i.e. WRONGTYPE) are the caller's.
+func rpcError(err error) error {
+	var rerr goredisv9.Error
+	switch {
+	case errors.As(err, &rerr):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, cluster.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, cluster.ErrBusy):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+// respValue converts a RESP reply to our Value.
+func respValue(r redcon.RESP) *v1.Value {
+	switch r.Type {
+	case redcon.Integer:
+		return &v1.Value{Kind: &v1.Value_Integer{Integer: r.Int()}}
+	case redcon.Error:
+		return &v1.Value{Kind: &v1.Value_Error{Error: string(r.Data)}}
+	case redcon.Array:
+		if r.Count < 0 { // null array
+			return &v1.Value{}
+		}
+
+		a := &v1.Array{}
+		r.ForEach(func(e redcon.RESP) bool {
+			a.Values = append(a.Values, respValue(e))
+			return true
+		})
+
+		return &v1.Value{Kind: &v1.Value_Array{Array: a}}
+	case redcon.Bulk:
+		if bytes.HasPrefix(r.Raw, []byte("$-")) { // null bulk
+			return &v1.Value{}
+		}
+	}
+
+	return &v1.Value{Kind: &v1.Value_Str{Str: append([]byte(nil), r.Data...)}}
+}
+
+// toValue converts a go-redis reply to our Value.
+func toValue(v interface{}) *v1.Value {
+	switch v := v.(type) {
+	case nil:
+		return &v1.Value{}
+	case string:
+		return &v1.Value{Kind: &v1.Value_Str{Str: []byte(v)}}
+	case []byte:
+		return &v1.Value{Kind: &v1.Value_Str{Str: v}}
+	case int64:
+		return &v1.Value{Kind: &v1.Value_Integer{Integer: v}}
+	case float64:
+		return &v1.Value{Kind: &v1.Value_Double{Double: v}}
+	case bool:
+		return &v1.Value{Kind: &v1.Value_Boolean{Boolean: v}}
+	case error:
+		return &v1.Value{Kind: &v1.Value_Error{Error: v.Error()}}
+	case []interface{}:
+		a := &v1.Array{}
+		for _, e := range v {
+			a.Values = append(a.Values, toValue(e))
+		}
+
+		return &v1.Value{Kind: &v1.Value_Array{Array: a}}
+	case map[interface{}]interface{}: // RESP3 maps, flattened
+		keys := []interface{}{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		a := &v1.Array{}
+		for _, k := range keys {
+			a.Values = append(a.Values, toValue(k), toValue(v[k]))
+		}
+
+		return &v1.Value{Kind: &v1.Value_Array{Array: a}}
+	default:
+		return &v1.Value{Kind: &v1.Value_Str{Str: []byte(fmt.Sprint(v))}}
+	}
+}
+
+// execConn is the redcon.Conn for Exec: it keeps the reply as RESP, for
+// respValue, except for proxied replies (written whole, with WriteAny), kept
+// as is for toValue; RESP would turn their integers into strings.
+type execConn struct {
+	addr   string
+	ctx    interface{}
+	buf    []byte
+	any    interface{}
+	isAny  bool
+	closed bool
+}
+
+// reply returns what was written to c, if complete.
+func (c *execConn) reply() (*v1.Value, bool) {
+	if c.isAny {
+		return toValue(c.any), true
+	}
+
+	n, r := redcon.ReadNextRESP(c.buf)
+	return respValue(r), n > 0
+}
+
+func (c *execConn) RemoteAddr() string             { return c.addr }
+func (c *execConn) Close() error                   { c.closed = true; return nil }
+func (c *execConn) WriteString(str string)         { c.buf = redcon.AppendString(c.buf, str) }
+func (c *execConn) WriteBulk(bulk []byte)          { c.buf = redcon.AppendBulk(c.buf, bulk) }
+func (c *execConn) WriteBulkString(bulk string)    { c.buf = redcon.AppendBulkString(c.buf, bulk) }
+func (c *execConn) WriteInt(num int)               { c.buf = redcon.AppendInt(c.buf, int64(num)) }
+func (c *execConn) WriteInt64(num int64)           { c.buf = redcon.AppendInt(c.buf, num) }
+func (c *execConn) WriteUint64(num uint64)         { c.buf = redcon.AppendUint(c.buf, num) }
+func (c *execConn) WriteArray(count int)           { c.buf = redcon.AppendArray(c.buf, count) }
+func (c *execConn) WriteNull()                     { c.buf = redcon.AppendNull(c.buf) }
+func (c *execConn) WriteRaw(data []byte)           { c.buf = append(c.buf, data...) }
+func (c *execConn) Context() interface{}           { return c.ctx }
+func (c *execConn) SetContext(v interface{})       { c.ctx = v }
+func (c *execConn) SetReadBuffer(int)              {}
+func (c *execConn) Detach() redcon.DetachedConn    { return nil } // DETACH is rejected
+func (c *execConn) ReadPipeline() []redcon.Command { return nil }
+func (c *execConn) PeekPipeline() []redcon.Command { return nil }
+func (c *execConn) NetConn() net.Conn              { return nil }
+
+func (c *execConn) WriteError(msg string) {
+	if msg == goredisv9.Nil.Error() { // Handler writes go-redis errors as is
+		c.WriteNull()
+		return
+	}
+
+	c.buf = redcon.AppendError(c.buf, msg)
+}
+
+func (c *execConn) WriteAny(v interface{}) {
+	if len(c.buf) == 0 && !c.isAny {
+		c.any, c.isAny = v, true
+		return
+	}
+
+	c.buf = redcon.AppendAny(c.buf, v)
 }